@@ -3,11 +3,31 @@ package main
 import (
 	"github.com/cortezaproject/corteza-server/compose"
 	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/crusttech/crust-server/pkg/subscription"
 )
 
 func main() {
 	cfg := compose.Configure()
 	cfg.RootCommandName = "crust-server-compose"
-	cmd := cfg.MakeCLI(cli.Context())
+	subscription.SetEdition(cfg.RootCommandName)
+	cfg.ApiServerPreRun = append(
+		cfg.ApiServerPreRun,
+		subscription.Standalone,
+		subscription.GuardServices,
+	)
+
+	cfg.ApiServerRoutes = append(
+		subscription.GuardRoutes(
+			cfg.ApiServerRoutes,
+			subscription.ReadOnly(),
+			subscription.FeatureMiddleware(subscription.ComposeRoutes),
+			subscription.QuotaMiddleware(subscription.ComposeQuotas),
+		),
+		subscription.MountMetrics,
+	)
+
+	ctx := cli.Context()
+	cmd := cfg.MakeCLI(ctx)
+	subscription.ServeAPI(ctx, cmd, cfg)
 	cli.HandleError(cmd.Execute())
 }
@@ -3,11 +3,32 @@ package main
 import (
 	"github.com/cortezaproject/corteza-server/messaging"
 	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/crusttech/crust-server/pkg/subscription"
 )
 
 func main() {
 	cfg := messaging.Configure()
 	cfg.RootCommandName = "crust-server-messaging"
-	cmd := cfg.MakeCLI(cli.Context())
+	subscription.SetEdition(cfg.RootCommandName)
+	cfg.ApiServerPreRun = append(
+		cfg.ApiServerPreRun,
+		subscription.Standalone,
+		subscription.GuardServices,
+	)
+
+	cfg.ApiServerRoutes = append(
+		subscription.GuardRoutes(
+			cfg.ApiServerRoutes,
+			subscription.ReadOnly(),
+			subscription.FeatureMiddleware(subscription.MessagingRoutes),
+			subscription.QuotaMiddleware(subscription.MessagingQuotas),
+			subscription.SessionMiddleware(subscription.MessagingSessions),
+		),
+		subscription.MountMetrics,
+	)
+
+	ctx := cli.Context()
+	cmd := cfg.MakeCLI(ctx)
+	subscription.ServeAPI(ctx, cmd, cfg)
 	cli.HandleError(cmd.Execute())
 }
@@ -15,6 +15,7 @@ import (
 func main() {
 	cfg := monolith.Configure()
 	cfg.RootCommandName = "crust-server"
+	subscription.SetEdition(cfg.RootCommandName)
 	cfg.ApiServerPreRun = append(
 		cfg.ApiServerPreRun,
 		func(ctx context.Context, cmd *cobra.Command, c *cli.Config) error {
@@ -25,10 +26,35 @@ func main() {
 
 			subscription.Init(logger.Default(), service.DefaultSettings)
 			subscription.UpdateCurrent(subscription.Load(ctx))
+			subscription.Watch(ctx)
+			subscription.ReportUsage(ctx)
+			subscription.Notify(ctx)
 			return nil
 		},
+		subscription.GuardServices,
 	)
 
-	cmd := cfg.MakeCLI(cli.Context())
+	cfg.ApiServerRoutes = append(
+		subscription.GuardRoutes(
+			cfg.ApiServerRoutes,
+			subscription.ReadOnly(subscription.MonolithWritable...),
+			subscription.FeatureMiddleware(subscription.MonolithRoutes),
+			subscription.QuotaMiddleware(subscription.MonolithQuotas),
+			subscription.SeatMiddleware(subscription.MonolithSeats),
+			subscription.SessionMiddleware(subscription.MonolithSessions),
+		),
+		subscription.MountRoutes,
+		subscription.MountMetrics,
+	)
+
+	cfg.AdtSubCommands = append(
+		cfg.AdtSubCommands,
+		subscription.Command,
+	)
+
+	ctx := cli.Context()
+	cmd := cfg.MakeCLI(ctx)
+	subscription.ServeAPI(ctx, cmd, cfg)
+	subscription.GuardCommands(ctx, cmd, cfg)
 	cli.HandleError(cmd.Execute())
 }
@@ -15,6 +15,7 @@ import (
 func main() {
 	cfg := system.Configure()
 	cfg.RootCommandName = "crust-server-system"
+	subscription.SetEdition(cfg.RootCommandName)
 
 	cfg.ApiServerPreRun = append(
 		cfg.ApiServerPreRun,
@@ -26,10 +27,34 @@ func main() {
 
 			subscription.Init(logger.Default(), service.DefaultSettings)
 			subscription.UpdateCurrent(subscription.Load(ctx))
+			subscription.Watch(ctx)
+			subscription.ReportUsage(ctx)
+			subscription.Notify(ctx)
 			return nil
 		},
+		subscription.GuardServices,
 	)
 
-	cmd := cfg.MakeCLI(cli.Context())
+	cfg.ApiServerRoutes = append(
+		subscription.GuardRoutes(
+			cfg.ApiServerRoutes,
+			subscription.ReadOnly(subscription.SystemWritable...),
+			subscription.FeatureMiddleware(subscription.SystemRoutes),
+			subscription.SeatMiddleware(subscription.SystemSeats),
+			subscription.SessionMiddleware(subscription.SystemSessions),
+		),
+		subscription.MountRoutes,
+		subscription.MountMetrics,
+	)
+
+	cfg.AdtSubCommands = append(
+		cfg.AdtSubCommands,
+		subscription.Command,
+	)
+
+	ctx := cli.Context()
+	cmd := cfg.MakeCLI(ctx)
+	subscription.ServeAPI(ctx, cmd, cfg)
+	subscription.GuardCommands(ctx, cmd, cfg)
 	cli.HandleError(cmd.Execute())
 }
@@ -3,13 +3,23 @@ module github.com/crusttech/crust-server
 go 1.12
 
 require (
+	github.com/99designs/basicauth-go v0.0.0-20160802081356-2a93ba0f464d
+	github.com/Masterminds/squirrel v1.1.1-0.20191017225151-12f2162c8d8d
 	github.com/cortezaproject/corteza-server v0.0.0-20200110160908-6f0a7efb96b4
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-chi/chi v3.3.4+incompatible
+	github.com/go-chi/jwtauth v0.0.0-20190109153619-47840abb19b3
+	github.com/jmoiron/sqlx v1.2.0
 	github.com/joho/godotenv v1.3.0
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/prometheus/client_golang v0.9.3 // indirect
+	github.com/markbates/goth v1.50.0
+	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v0.9.3
+	github.com/sony/sonyflake v0.0.0-20181109022403-6d5bd6181009
 	github.com/spf13/cobra v0.0.3
+	github.com/titpetric/factory v0.0.0-20190806200833-ae4b02b9e034
 	go.uber.org/zap v1.10.0
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
 
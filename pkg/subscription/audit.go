@@ -0,0 +1,270 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// AuditEvent is a persisted subscription or licensing event
+	AuditEvent struct {
+		ID      uint64 `json:"eventID,string" db:"id"`
+		Event   string `json:"event" db:"event"`
+		Message string `json:"message" db:"message"`
+		// User that caused the event, 0 for system and CLI
+		ActorID   uint64    `json:"actorID,string" db:"rel_actor"`
+		CreatedAt time.Time `json:"createdAt" db:"created_at"`
+
+		// Snapshot of subscription claims at the time of the event
+		Claims types.JSONText `json:"claims" db:"claims"`
+	}
+
+	AuditFilter struct {
+		Event string
+		Since time.Time
+		Limit uint
+	}
+
+	// Event to be recorded later (see audit), when caller is done with its locks
+	auditEntry struct {
+		event   string
+		message string
+
+		// Record with auditLimited
+		limited bool
+	}
+
+	// Events recorded by auditLimited, by event & organisation
+	auditLimiter struct {
+		sync.Mutex
+		recorded map[string]time.Time
+		skipped  map[string]uint
+	}
+
+	// Remembers which expiration events were recorded for the current expiration date
+	expiryState struct {
+		sync.Mutex
+		expires  time.Time
+		expired  bool
+		readOnly bool
+	}
+)
+
+// Audit events
+const (
+	AuditKeyInstalled         = "key-installed"
+	AuditKeyRemoved           = "key-removed"
+	AuditKeyChanged           = "key-changed"
+	AuditParseFailed          = "parse-failed"
+	AuditInstallationMismatch = "installation-mismatch"
+	AuditTrialCreated         = "trial-created"
+	AuditTrialTampered        = "trial-tampered"
+	AuditTrialReset           = "trial-reset"
+	AuditExpired              = "expired"
+	AuditReadOnly             = "read-only"
+	AuditSeatLimitReached     = "seat-limit-reached"
+	AuditSessionLimitReached  = "session-limit-reached"
+	AuditSessionEvicted       = "session-evicted"
+	AuditRegistrationBlocked  = "registration-blocked"
+)
+
+const (
+	auditTable = "crust_subscription_audit"
+
+	auditDefaultLimit uint = 100
+
+	// How often are events that anyone can cause (blocked signups,
+	// rejected logins) recorded, see auditLimited
+	auditLimitInterval = 5 * time.Minute
+)
+
+var (
+	// Table is created on start (see createTables)
+	auditTableDDL = `CREATE TABLE IF NOT EXISTS ` + auditTable + ` (
+  id         BIGINT UNSIGNED NOT NULL,
+  event      VARCHAR(64)     NOT NULL,
+  message    TEXT            NOT NULL,
+  rel_actor  BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  claims     JSON                NULL,
+  created_at DATETIME        NOT NULL,
+
+  PRIMARY KEY (id),
+  KEY idx_event (event),
+  KEY idx_created_at (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+	lastExpiry = &expiryState{}
+
+	limiter = &auditLimiter{
+		recorded: map[string]time.Time{},
+		skipped:  map[string]uint{},
+	}
+)
+
+// Records subscription event
+//
+// Actor is taken from the context, claims default to the subscription
+// the request is evaluated against (see subscriptionFor).
+// Events that can not be recorded are logged and otherwise ignored.
+func audit(ctx context.Context, event string, c *Claims, message string) {
+	if c == nil {
+		if s := subscriptionFor(ctx); s != nil {
+			c = s.claims()
+		}
+	}
+
+	var (
+		e = &AuditEvent{
+			ID:        factory.Sonyflake.NextID(),
+			Event:     event,
+			Message:   message,
+			ActorID:   auth.GetIdentityFromContext(ctx).Identity(),
+			CreatedAt: now(),
+		}
+
+		log = logger.With(zap.String("event", event), zap.String("message", message))
+	)
+
+	// Marshals to null when there are no claims
+	e.Claims, _ = json.Marshal(c)
+
+	db, err := systemDB(ctx)
+	if err == nil {
+		err = db.Insert(auditTable, e)
+	}
+
+	if err != nil {
+		log.Warn("could not record subscription event", zap.Error(err))
+		return
+	}
+
+	log.Debug("subscription event recorded")
+}
+
+// Records subscription event at most once per auditLimitInterval
+// (per event & organisation of the request)
+//
+// Used for events that anyone can cause by repeating the request; events that
+// are not recorded are counted and the count is added to the next recorded one.
+// Metrics count all of them.
+func auditLimited(ctx context.Context, event string, c *Claims, message string) {
+	var key = event + "/" + strconv.FormatUint(organisationOf(ctx), 10)
+
+	limiter.Lock()
+	if last, ok := limiter.recorded[key]; ok && now().Sub(last) < auditLimitInterval {
+		limiter.skipped[key]++
+		limiter.Unlock()
+		return
+	}
+
+	var skipped = limiter.skipped[key]
+	limiter.recorded[key] = now()
+	delete(limiter.skipped, key)
+	limiter.Unlock()
+
+	if skipped > 0 {
+		message += fmt.Sprintf(" (%d more since the last record)", skipped)
+	}
+
+	audit(ctx, event, c, message)
+}
+
+// AuditEvents returns recorded subscription events, most recent first
+func AuditEvents(ctx context.Context, f AuditFilter) ([]*AuditEvent, error) {
+	var (
+		ee = make([]*AuditEvent, 0)
+		q  = squirrel.
+			Select("id", "event", "message", "rel_actor", "claims", "created_at").
+			From(auditTable).
+			OrderBy("created_at DESC", "id DESC")
+	)
+
+	db, err := systemDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Event != "" {
+		q = q.Where(squirrel.Eq{"event": f.Event})
+	}
+
+	if !f.Since.IsZero() {
+		q = q.Where(squirrel.GtOrEq{"created_at": f.Since})
+	}
+
+	if f.Limit == 0 {
+		f.Limit = auditDefaultLimit
+	}
+
+	return ee, rh.FetchAll(db, q.Limit(uint64(f.Limit)), &ee)
+}
+
+// Records expiration events when current subscription expires or
+// switches to read-only mode
+//
+// Events are recorded once per expiration date, even when
+// server restarts or runs in multiple replicas
+func auditExpiry(ctx context.Context) {
+	s, ok := service.CurrentSubscription.(*subscription)
+	if !ok {
+		return
+	}
+
+	s.RLock()
+	var (
+		valid      = s.isValid
+		expires    = s.expires
+		readOnlyAt = s.expires.AddDate(0, 0, int(s.graceDays))
+	)
+	s.RUnlock()
+
+	if !valid {
+		return
+	}
+
+	lastExpiry.Lock()
+	defer lastExpiry.Unlock()
+
+	if !lastExpiry.expires.Equal(expires) {
+		// Subscription was renewed (or replaced)
+		lastExpiry.expires, lastExpiry.expired, lastExpiry.readOnly = expires, false, false
+	}
+
+	if !lastExpiry.expired && !now().Before(expires) {
+		lastExpiry.expired = auditOnce(ctx, AuditExpired, expires, "subscription expired")
+	}
+
+	if !lastExpiry.readOnly && now().After(readOnlyAt) {
+		lastExpiry.readOnly = auditOnce(ctx, AuditReadOnly, readOnlyAt, "subscription switched to read-only mode")
+	}
+}
+
+// Records event unless it was already recorded since the given time
+//
+// Returns true when event is recorded
+func auditOnce(ctx context.Context, event string, since time.Time, message string) bool {
+	ee, err := AuditEvents(ctx, AuditFilter{Event: event, Since: since, Limit: 1})
+	if err != nil {
+		logger.Warn("could not check subscription events", zap.String("event", event), zap.Error(err))
+		return false
+	}
+
+	if len(ee) == 0 {
+		audit(ctx, event, nil, message)
+	}
+
+	return true
+}
@@ -0,0 +1,100 @@
+package subscription
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+)
+
+type (
+	// Branding holds values used in subscription messages
+	//
+	// Empty values are not set and fall back to the next source:
+	// signed claims, then settings, then Crust defaults
+	Branding struct {
+		ProductName  string `json:"productName,omitempty"`
+		ContactEmail string `json:"contactEmail,omitempty"`
+		RenewalURL   string `json:"renewalURL,omitempty"`
+	}
+
+	brandingSettings struct {
+		sync.RWMutex
+		Branding
+	}
+)
+
+const (
+	settingBrandingProductNameKey  = "crust-subscription.branding.product-name"
+	settingBrandingContactEmailKey = "crust-subscription.branding.contact-email"
+	settingBrandingRenewalURLKey   = "crust-subscription.branding.renewal-url"
+)
+
+var (
+	defaultBranding = Branding{
+		ProductName:  "Crust",
+		ContactEmail: salesEmail,
+	}
+
+	// Branding loaded from settings
+	configured = &brandingSettings{}
+)
+
+// Returns copy of b with empty values replaced by values from o
+func (b Branding) merge(o Branding) Branding {
+	if b.ProductName == "" {
+		b.ProductName = o.ProductName
+	}
+
+	if b.ContactEmail == "" {
+		b.ContactEmail = o.ContactEmail
+	}
+
+	if b.RenewalURL == "" {
+		b.RenewalURL = o.RenewalURL
+	}
+
+	return b
+}
+
+func (bs *brandingSettings) get() Branding {
+	bs.RLock()
+	defer bs.RUnlock()
+	return bs.Branding
+}
+
+func (bs *brandingSettings) set(b Branding) {
+	bs.Lock()
+	defer bs.Unlock()
+	bs.Branding = b
+}
+
+// Loads branding overrides from settings
+func loadBranding(ctx context.Context) error {
+	if settingsSvc == nil {
+		return nil
+	}
+
+	var (
+		b  = Branding{}
+		kv = map[string]*string{
+			settingBrandingProductNameKey:  &b.ProductName,
+			settingBrandingContactEmailKey: &b.ContactEmail,
+			settingBrandingRenewalURLKey:   &b.RenewalURL,
+		}
+	)
+
+	ctx = auth.SetSuperUserContext(ctx)
+
+	for name, dst := range kv {
+		v, err := settingsSvc.Get(ctx, name, 0)
+		if err != nil {
+			return err
+		}
+
+		*dst = v.String()
+	}
+
+	configured.set(b)
+	return nil
+}
@@ -1,9 +1,13 @@
 package subscription
 
 import (
+	"context"
+	"encoding/json"
+	"math"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"github.com/cortezaproject/corteza-server/system/service"
@@ -11,39 +15,236 @@ import (
 
 type (
 	Claims struct {
-		Domains  []string
+		// Subscription ID, used for revocation
+		ID string `json:"jti,omitempty"`
+
+		// Registered claims (RFC 7519), unix timestamps; all optional
+		//
+		// Standard exp is used as an alternative to legacy Expires;
+		// when both are set, the earlier one applies
+		Issuer    string   `json:"iss,omitempty"`
+		Audience  audience `json:"aud,omitempty"`
+		ExpiresAt int64    `json:"exp,omitempty"`
+		NotBefore int64    `json:"nbf,omitempty"`
+		IssuedAt  int64    `json:"iat,omitempty"`
+
+		Domains []string
+
+		// IDs of installations this subscription is issued for,
+		// valid for any installation when empty
+		Installations []string
+
 		Trial    bool
 		MaxUsers uint
 		Expires  time.Time
+
+		// Max number of concurrent sessions (logins and websocket
+		// connections), not limited when 0
+		MaxSessions uint
+
+		// List of features this subscription includes,
+		// all features are included when empty
+		Entitlements []string
+
+		// Resource quotas (see Quota* constants), resources w/o quota are not limited
+		//
+		// Quotas of organisation keys apply to resources of the organisation
+		Quotas map[string]uint64
+
+		// How seats are counted (see SeatPolicy* constants),
+		// only active, human users are counted when empty
+		SeatPolicy string
+
+		// Number of days after expiration before server switches to read-only mode,
+		// server's default (SUBSCRIPTION_GRACE_DAYS) applies when not set
+		GraceDays *uint
+
+		// White-label values used in subscription messages,
+		// override the ones from settings
+		Branding Branding
 	}
+
+	// Audience claim, single string or list of strings
+	audience []string
 )
 
 const (
 	HEADER_TYPE = "crust-subscription"
+
+	// Audience of all subscription keys for this product, see SetEdition
+	productAudience = "crust-server"
+)
+
+var (
+	// Edition (server binary) subscription keys can be issued for
+	edition string
+)
+
+// Features that subscription can be entitled to
+const (
+	FeatureCompose      = "compose"
+	FeatureMessaging    = "messaging"
+	FeatureAutomation   = "automation"
+	FeatureExternalAuth = "external-auth"
+	FeatureApiSinks     = "api-sinks"
+)
+
+// Resources that subscription can set quota for
+const (
+	QuotaNamespaces   = "compose.namespaces"
+	QuotaModules      = "compose.modules"
+	QuotaRecords      = "compose.records"
+	QuotaChannels     = "messaging.channels"
+	QuotaStorageBytes = "storage.bytes"
 )
 
-func (Claims) Valid() error {
+// Valid validates registered claims
+//
+// Expiration is not validated here; expired subscription is still valid and
+// is handled by the subscription itself (warnings, grace period, read-only mode)
+//
+// Keys w/o registered claims (legacy keys) are valid. Key that is not valid
+// yet returns transientError.
+func (c Claims) Valid() error {
+	var (
+		t    = now().Unix()
+		skew = int64(opt.ClockSkew / time.Second)
+	)
+
+	switch {
+	case c.NotBefore > 0 && t+skew < c.NotBefore:
+		return transientError{errors.Errorf("subscription key is not valid before %s", time.Unix(c.NotBefore, 0).Format(time.RFC3339))}
+
+	case c.IssuedAt > 0 && t+skew < c.IssuedAt:
+		return errors.Errorf("subscription key is issued in the future (%s)", time.Unix(c.IssuedAt, 0).Format(time.RFC3339))
+
+	case c.Issuer != "" && opt.Issuer != "" && c.Issuer != opt.Issuer:
+		return errors.Errorf("unexpected subscription key issuer %q", c.Issuer)
+
+	case len(c.Audience) > 0 && !c.Audience.contains(audiences()...):
+		return errors.Errorf("subscription key is not issued for this product (%v)", []string(c.Audience))
+	}
+
 	return nil
 }
 
+// Applies standard exp claim to Expires
+func (c *Claims) normalize() {
+	if c.ExpiresAt == 0 {
+		return
+	}
+
+	if exp := time.Unix(c.ExpiresAt, 0); c.Expires.IsZero() || exp.Before(c.Expires) {
+		c.Expires = exp
+	}
+}
+
+// SetEdition sets edition (name of the server binary) that subscription keys
+// can be issued for in addition to the whole product
+func SetEdition(name string) {
+	edition = name
+}
+
+// Returns accepted audiences: configured ones or product and edition
+func audiences() []string {
+	if len(opt.Audience) > 0 {
+		return opt.Audience
+	}
+
+	if edition != "" && edition != productAudience {
+		return []string{productAudience, edition}
+	}
+
+	return []string{productAudience}
+}
+
+// UnmarshalJSON accepts single string or list of strings
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	*a = list
+	return nil
+}
+
+// Does audience contain any of the given values
+func (a audience) contains(vv ...string) bool {
+	for _, aud := range a {
+		for _, v := range vv {
+			if aud == v {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DaysLeft returns number of days until subscription expires
+func (c Claims) DaysLeft() int {
+	return int(math.Floor(c.Expires.Sub(now()).Hours() / 24))
+}
+
+// Returns number of grace days, server's default when key does not set them
+func (c Claims) gracePeriod() uint {
+	if c.GraceDays == nil {
+		return opt.GraceDays
+	}
+
+	return *c.GraceDays
+}
+
 func UpdateCurrent(c *Claims) {
 	if c == nil {
 		return
 	}
 
+	if s := current(); s != nil {
+		s.Update(c)
+
+		logger.Info("subscription updated",
+			zap.Strings("domains", c.Domains),
+			zap.Time("expires", c.Expires),
+			zap.Bool("is-trial", c.Trial),
+			zap.Uint("limit-max-users", c.MaxUsers),
+			zap.Uint("limit-max-sessions", c.MaxSessions),
+			zap.String("seat-policy", c.SeatPolicy),
+			zap.Strings("entitlements", c.Entitlements),
+			zap.Any("quotas", c.Quotas),
+			zap.Uint("grace-days", c.gracePeriod()))
+
+		publishState(context.Background())
+	}
+}
+
+// ResetCurrent invalidates current subscription
+func ResetCurrent() {
+	if s := current(); s != nil {
+		s.Reset()
+		logger.Info("subscription reset")
+
+		publishState(context.Background())
+	}
+}
+
+// Returns current subscription, initializes it if needed
+func current() *subscription {
 	if service.CurrentSubscription == nil {
 		service.CurrentSubscription = &subscription{}
 	}
 
 	if s, ok := service.CurrentSubscription.(*subscription); !ok {
 		logger.Error("unknown service.CurrentSubscription type")
+		return nil
 	} else {
-		s.Update(c.Domains, c.Expires, c.Trial, c.MaxUsers)
-
-		logger.Info("subscription updated",
-			zap.Strings("domains", c.Domains),
-			zap.Time("expires", c.Expires),
-			zap.Bool("is-trial", c.Trial),
-			zap.Uint("limit-max-users", c.MaxUsers))
+		return s
 	}
 }
@@ -0,0 +1,153 @@
+package subscription
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Fixes time, returns function that restores time and options
+//
+//	defer fixClock(at)()
+func fixClock(at time.Time) func() {
+	var (
+		prevNow = now
+		prevOpt = opt
+		copied  = *opt
+	)
+
+	// Options can be changed by the test
+	opt = &copied
+
+	now = func() time.Time { return at }
+	return func() {
+		now = prevNow
+		opt = prevOpt
+	}
+}
+
+func TestClaimsValid(t *testing.T) {
+	var (
+		at  = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+		sec = func(d time.Duration) int64 { return at.Add(d).Unix() }
+	)
+
+	defer fixClock(at)()
+	opt.ClockSkew = 5 * time.Minute
+	opt.Issuer = "crust.tech"
+	opt.Audience = nil
+	SetEdition("")
+
+	tests := []struct {
+		name      string
+		claims    Claims
+		valid     bool
+		transient bool
+	}{
+		{"legacy key", Claims{Domains: []string{"example.com"}}, true, false},
+		{"all claims", Claims{Issuer: "crust.tech", Audience: audience{productAudience}, NotBefore: sec(-time.Hour), IssuedAt: sec(-time.Hour)}, true, false},
+		{"nbf within skew", Claims{NotBefore: sec(time.Minute)}, true, false},
+		{"nbf in future", Claims{NotBefore: sec(time.Hour)}, false, true},
+		{"iat within skew", Claims{IssuedAt: sec(time.Minute)}, true, false},
+		{"iat in future", Claims{IssuedAt: sec(time.Hour)}, false, false},
+		{"unexpected issuer", Claims{Issuer: "example.com"}, false, false},
+		{"other audience", Claims{Audience: audience{"other-product"}}, false, false},
+		{"one of audiences", Claims{Audience: audience{"other-product", productAudience}}, true, false},
+		{"expired", Claims{ExpiresAt: sec(-24 * time.Hour), Expires: at.Add(-24 * time.Hour)}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.claims.Valid()
+			if (err == nil) != tt.valid {
+				t.Fatalf("Valid() = %v, want valid: %v", err, tt.valid)
+			}
+
+			if isTransient(err) != tt.transient {
+				t.Errorf("isTransient(%v) = %v, want %v", err, !tt.transient, tt.transient)
+			}
+		})
+	}
+}
+
+func TestClaimsValidAudience(t *testing.T) {
+	defer fixClock(time.Now())()
+	opt.Audience = nil
+
+	defer SetEdition("")
+
+	tests := []struct {
+		edition  string
+		audience []string
+		claim    audience
+		valid    bool
+	}{
+		{"", nil, audience{productAudience}, true},
+		{"crust-server-system", nil, audience{"crust-server-system"}, true},
+		{"crust-server-system", nil, audience{productAudience}, true},
+		{"crust-server-system", nil, audience{"crust-server-compose"}, false},
+		{"", []string{"custom"}, audience{"custom"}, true},
+		{"", []string{"custom"}, audience{productAudience}, false},
+	}
+
+	for _, tt := range tests {
+		SetEdition(tt.edition)
+		opt.Audience = tt.audience
+
+		if err := (Claims{Audience: tt.claim}).Valid(); (err == nil) != tt.valid {
+			t.Errorf("edition %q, audience %v: Valid(%v) = %v, want valid: %v", tt.edition, tt.audience, tt.claim, err, tt.valid)
+		}
+	}
+}
+
+func TestAudienceUnmarshal(t *testing.T) {
+	tests := []struct {
+		json string
+		want []string
+		err  bool
+	}{
+		{`"crust-server"`, []string{"crust-server"}, false},
+		{`["crust-server","crust-server-system"]`, []string{"crust-server", "crust-server-system"}, false},
+		{`[]`, []string{}, false},
+		{`42`, nil, true},
+	}
+
+	for _, tt := range tests {
+		var a audience
+		err := json.Unmarshal([]byte(tt.json), &a)
+		if (err != nil) != tt.err {
+			t.Errorf("unmarshal %s: error %v, want error: %v", tt.json, err, tt.err)
+			continue
+		}
+
+		if !tt.err && !equalStrings(a, tt.want) {
+			t.Errorf("unmarshal %s = %v, want %v", tt.json, a, tt.want)
+		}
+	}
+}
+
+func TestClaimsNormalize(t *testing.T) {
+	var (
+		early = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+		late  = time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	tests := []struct {
+		name   string
+		claims Claims
+		want   time.Time
+	}{
+		{"no exp", Claims{Expires: late}, late},
+		{"exp only", Claims{ExpiresAt: early.Unix()}, early},
+		{"exp before expires", Claims{ExpiresAt: early.Unix(), Expires: late}, early},
+		{"exp after expires", Claims{ExpiresAt: late.Unix(), Expires: early}, early},
+		{"neither", Claims{}, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		tt.claims.normalize()
+		if !tt.claims.Expires.Equal(tt.want) {
+			t.Errorf("%s: Expires = %v, want %v", tt.name, tt.claims.Expires, tt.want)
+		}
+	}
+}
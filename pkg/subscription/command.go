@@ -0,0 +1,459 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+var (
+	// Commands included only in builds with extra tags (see command_sign.go)
+	optionalCommands []func() *cobra.Command
+)
+
+// Command creates subscription management commands
+//
+// Expected to be registered through cli.Config's AdtSubCommands
+func Command(ctx context.Context, c *cli.Config) *cobra.Command {
+	var (
+		cmd = &cobra.Command{
+			Use:   "subscription",
+			Short: "Subscription management",
+		}
+	)
+
+	// Initializes services and subscription pkg with system settings
+	initServices := func() {
+		c.InitServices(ctx, c)
+		Init(c.Log, service.DefaultSettings)
+	}
+
+	install := &cobra.Command{
+		Use:   "install [file or - for stdin]",
+		Short: "Verify and install subscription key",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			initServices()
+
+			_, err := loadRevocations(ctx)
+			cli.HandleError(err)
+
+			key, err := readKey(args[0])
+			cli.HandleError(err)
+
+			claims, err := parseInstalled(ctx, key)
+			cli.HandleError(err)
+
+			organisationID, _ := cmd.Flags().GetUint64("organisation")
+			if organisationID > 0 {
+				v := &settings.Value{Name: organisationKeySetting(organisationID)}
+				cli.HandleError(v.SetValue(key))
+				cli.HandleError(settingsSvc.Set(auth.SetSuperUserContext(ctx), v))
+				audit(ctx, AuditKeyInstalled, claims, "subscription key of organisation "+strconv.FormatUint(organisationID, 10)+" installed")
+
+				cmd.Printf("Subscription key of organisation %d installed\n", organisationID)
+
+				if !opt.Tenants {
+					cmd.Println("Warning: installed key is not active, organisation subscriptions are disabled (SUBSCRIPTION_TENANTS)")
+				}
+
+				printClaims(cmd, claims)
+				return
+			}
+
+			v := &settings.Value{Name: settingSubscriptionJwtKey}
+			cli.HandleError(v.SetValue(key))
+			cli.HandleError(settingsSvc.Set(auth.SetSuperUserContext(ctx), v))
+			audit(ctx, AuditKeyInstalled, claims, "subscription key installed")
+
+			cmd.Println("Subscription key installed")
+
+			if source := overridingSource(); source != "" {
+				cmd.Printf("Warning: installed key is not active, subscription key from %s takes precedence\n", source)
+			}
+
+			printClaims(cmd, claims)
+		},
+	}
+
+	install.Flags().Uint64("organisation", 0, "Install key for the organisation with this ID (multi-tenant hosting)")
+
+	show := &cobra.Command{
+		Use:   "show",
+		Short: "Show current subscription",
+		Run: func(cmd *cobra.Command, args []string) {
+			initServices()
+
+			claims, err := Peek(ctx)
+			cli.HandleError(err)
+
+			id, err := loadInstallationID(ctx)
+			cli.HandleError(err)
+
+			cmd.Printf("Install ID: %s\n", id)
+			cmd.Printf("Source:     %s\n", Source())
+			printClaims(cmd, claims)
+
+			if !opt.Tenants {
+				return
+			}
+
+			keys, err := organisationKeys(ctx)
+			cli.HandleError(err)
+
+			var ids = make([]uint64, 0, len(keys))
+			for id := range keys {
+				ids = append(ids, id)
+			}
+
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+			for _, id := range ids {
+				cmd.Printf("\nOrg ID:     %d\n", id)
+
+				if claims, err := peekKey(ctx, keys[id]); err != nil {
+					cmd.Printf("Invalid subscription key: %v\n", err)
+				} else {
+					printClaims(cmd, claims)
+				}
+			}
+		},
+	}
+
+	verify := &cobra.Command{
+		Use:   "verify [file or - for stdin]",
+		Short: "Verify subscription key without installing it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if offline, _ := cmd.Flags().GetBool("offline"); offline {
+				initKeyring()
+			} else {
+				// Revoked keys are not valid
+				initServices()
+				cli.HandleError(peekRevocations(ctx))
+			}
+
+			key, err := readKey(args[0])
+			cli.HandleError(err)
+
+			claims, err := parse(key)
+			cli.HandleError(err)
+
+			cmd.Println("Subscription key is valid")
+			printClaims(cmd, claims)
+		},
+	}
+
+	verify.Flags().Bool("offline", false, "Verify w/o loading revocation list from the database")
+
+	remove := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove installed subscription key",
+		Run: func(cmd *cobra.Command, args []string) {
+			initServices()
+
+			organisationID, _ := cmd.Flags().GetUint64("organisation")
+			if organisationID > 0 {
+				cli.HandleError(settingsSvc.Delete(auth.SetSuperUserContext(ctx), organisationKeySetting(organisationID), 0))
+				audit(ctx, AuditKeyRemoved, nil, "subscription key of organisation "+strconv.FormatUint(organisationID, 10)+" removed")
+				cmd.Printf("Subscription key of organisation %d removed\n", organisationID)
+				return
+			}
+
+			cli.HandleError(settingsSvc.Delete(auth.SetSuperUserContext(ctx), settingSubscriptionJwtKey, 0))
+			audit(ctx, AuditKeyRemoved, nil, "subscription key removed")
+			cmd.Println("Subscription key removed")
+		},
+	}
+
+	remove.Flags().Uint64("organisation", 0, "Remove key of the organisation with this ID")
+
+	installation := &cobra.Command{
+		Use:   "installation-id",
+		Short: "Show ID of this installation (to be sent when ordering a subscription)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			initServices()
+
+			id, err := InstallationID(ctx)
+			cli.HandleError(err)
+			cmd.Println(id)
+
+			if show, _ := cmd.Flags().GetBool("public-key"); show {
+				key, err := InstallationPublicKey(ctx)
+				cli.HandleError(err)
+				cmd.Print(key)
+			}
+		},
+	}
+
+	installation.Flags().Bool("public-key", false, "Show public key of this installation too (usage reports are signed with it)")
+
+	resetTrial := &cobra.Command{
+		Use:   "reset-trial",
+		Short: "Issue a new generic trial that starts today",
+		Long: "Replaces generic trial (expired or tampered with) with a new one that starts today.\n" +
+			"Reset is recorded in the audit log; it has to be confirmed with --force.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if force, _ := cmd.Flags().GetBool("force"); !force {
+				cli.HandleError(errors.New("reset-trial grants a new trial period, use --force to confirm"))
+			}
+
+			initServices()
+
+			claims, err := resetTrial(ctx)
+			cli.HandleError(err)
+
+			cmd.Println("Generic trial reset")
+			printClaims(cmd, claims)
+		},
+	}
+
+	resetTrial.Flags().Bool("force", false, "Confirm that a new trial should be issued")
+
+	usageReport := &cobra.Command{
+		Use:   "usage-report [file or - for stdout]",
+		Short: "Generate signed usage report",
+		Long: "Collects usage of this installation (users, seats, resources) and writes it as JSON\n" +
+			"document, signed with the installation key. Report can be sent to the vendor manually.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			initServices()
+
+			if claims, err := Peek(ctx); err != nil {
+				// Report is still useful, w/o subscription details
+				logger.Warn("could not load subscription", zap.Error(err))
+			} else {
+				UpdateCurrent(claims)
+			}
+
+			newPeriod, _ := cmd.Flags().GetBool("new-period")
+
+			r, err := CollectUsage(ctx, newPeriod)
+			cli.HandleError(err)
+
+			sr, err := SignUsageReport(ctx, r)
+			cli.HandleError(err)
+
+			buf, err := json.MarshalIndent(sr, "", "  ")
+			cli.HandleError(err)
+
+			if args[0] == "-" {
+				cmd.Println(string(buf))
+				return
+			}
+
+			cli.HandleError(ioutil.WriteFile(args[0], buf, 0640))
+
+			cmd.Printf("Usage report written to %s\n", args[0])
+			cmd.Printf("Period:     since %s\n", r.PeriodStart.Format(time.RFC1123))
+			cmd.Printf("Seats:      %d active, %d at peak\n", r.Seats.Active, r.PeakActiveUsers)
+
+			for _, resource := range r.resources() {
+				cmd.Printf("Usage:      %s = %d\n", resource, r.Resources[resource])
+			}
+		},
+	}
+
+	usageReport.Flags().Bool("new-period", false, "Start new reporting period (resets peak values)")
+
+	auditLog := &cobra.Command{
+		Use:   "audit",
+		Short: "List subscription events",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			initServices()
+
+			var f = AuditFilter{}
+
+			f.Event, _ = cmd.Flags().GetString("event")
+			f.Limit, _ = cmd.Flags().GetUint("limit")
+
+			if since, _ := cmd.Flags().GetDuration("since"); since > 0 {
+				f.Since = now().Add(-since)
+			}
+
+			ee, err := AuditEvents(ctx, f)
+			cli.HandleError(err)
+
+			for _, e := range ee {
+				cmd.Printf("%s  %-22s  actor: %-20d  %s\n", e.CreatedAt.Format(time.RFC3339), e.Event, e.ActorID, e.Message)
+			}
+		},
+	}
+
+	auditLog.Flags().String("event", "", "Show only events of this type")
+	auditLog.Flags().Duration("since", 0, "Show only events that happened in this period (e.g. 720h)")
+	auditLog.Flags().Uint("limit", auditDefaultLimit, "Max number of events")
+
+	cmd.AddCommand(
+		install,
+		show,
+		verify,
+		remove,
+		resetTrial,
+		installation,
+		usageReport,
+		auditLog,
+	)
+
+	for _, mk := range optionalCommands {
+		cmd.AddCommand(mk())
+	}
+
+	return cmd
+}
+
+// GuardCommands makes corteza's user commands (users add) check and
+// reserve subscription seats, same as API does
+//
+// Expected to be called on the command that cli.Config's MakeCLI returns,
+// see ServeAPI
+func GuardCommands(ctx context.Context, cmd *cobra.Command, c *cli.Config) {
+	for _, sub := range cmd.Commands() {
+		if sub.Name() == "add" && cmd.Name() == "users" && sub.Run != nil {
+			sub.Run = guardUserAdd(ctx, c, sub.Run)
+		}
+
+		GuardCommands(ctx, sub, c)
+	}
+}
+
+// Wraps users add command, user is created only when there is a free seat
+func guardUserAdd(ctx context.Context, c *cli.Config, run func(*cobra.Command, []string)) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		c.InitServices(ctx, c)
+		Init(c.Log, service.DefaultSettings)
+
+		if exists, err := userExists(ctx, args[0]); err != nil {
+			cli.HandleError(err)
+		} else if exists {
+			// Command reports existing user on its own
+			run(cmd, args)
+			return
+		}
+
+		release, err := ReserveSeat(ctx)
+		cli.HandleError(err)
+		defer release()
+
+		UpdateCurrent(Load(ctx))
+		cli.HandleError(current().checkSeats(ctx))
+
+		run(cmd, args)
+	}
+}
+
+// Reads subscription key from file or stdin (when "-" is used)
+func readKey(path string) (string, error) {
+	buf, err := readInput(path)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read subscription key")
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// Reads file or stdin (when "-" is used)
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+func printClaims(cmd *cobra.Command, c *Claims) {
+	var (
+		domains      = "any"
+		trial        = "no"
+		maxUsers     = "unlimited"
+		entitlements = "all"
+	)
+
+	if len(c.Domains) > 0 {
+		domains = strings.Join(c.Domains, ", ")
+	}
+
+	if c.Trial {
+		trial = "yes"
+	}
+
+	if c.MaxUsers > 0 {
+		maxUsers = strconv.FormatUint(uint64(c.MaxUsers), 10)
+	}
+
+	if len(c.Entitlements) > 0 {
+		entitlements = strings.Join(c.Entitlements, ", ")
+	}
+
+	if c.ID != "" {
+		cmd.Printf("ID:         %s\n", c.ID)
+	}
+
+	if c.Issuer != "" {
+		cmd.Printf("Issuer:     %s\n", c.Issuer)
+	}
+
+	if len(c.Audience) > 0 {
+		cmd.Printf("Audience:   %s\n", strings.Join(c.Audience, ", "))
+	}
+
+	if c.IssuedAt > 0 {
+		cmd.Printf("Issued:     %s\n", time.Unix(c.IssuedAt, 0).Format(time.RFC1123))
+	}
+
+	if c.NotBefore > 0 {
+		cmd.Printf("Not before: %s\n", time.Unix(c.NotBefore, 0).Format(time.RFC1123))
+	}
+
+	cmd.Printf("Domains:    %s\n", domains)
+
+	if len(c.Installations) > 0 {
+		cmd.Printf("Installs:   %s\n", strings.Join(c.Installations, ", "))
+	}
+
+	cmd.Printf("Trial:      %s\n", trial)
+	cmd.Printf("Max users:  %s\n", maxUsers)
+	cmd.Printf("Seats:      %s\n", seatPolicy(c.SeatPolicy))
+
+	if c.MaxSessions > 0 {
+		cmd.Printf("Sessions:   %d concurrent\n", c.MaxSessions)
+	}
+
+	cmd.Printf("Expires:    %s\n", c.Expires.Format(time.RFC1123))
+	cmd.Printf("Days left:  %d\n", c.DaysLeft())
+	cmd.Printf("Grace days: %d\n", c.gracePeriod())
+	cmd.Printf("Features:   %s\n", entitlements)
+
+	for r, q := range c.Quotas {
+		cmd.Printf("Quota:      %s = %d\n", r, q)
+	}
+
+	if c.Branding.ProductName != "" {
+		cmd.Printf("Product:    %s\n", c.Branding.ProductName)
+	}
+
+	if c.Branding.ContactEmail != "" {
+		cmd.Printf("Contact:    %s\n", c.Branding.ContactEmail)
+	}
+
+	if c.Branding.RenewalURL != "" {
+		cmd.Printf("Renew at:   %s\n", c.Branding.RenewalURL)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build signer
+// +build signer
+
+package subscription
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cortezaproject/corteza-server/pkg/cli"
+)
+
+// Sign command is for issuing keys locally (testing, partners that issue
+// on-premise keys); it is not included in release builds.
+//
+// Build with -tags signer to include it.
+func init() {
+	optionalCommands = append(optionalCommands, signCommand)
+}
+
+func signCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sign [claims file or - for stdin]",
+		Short: "Create subscription key from claims, signed with a local private key",
+		Long: "Creates subscription key from JSON encoded claims (Claims fields, e.g. {\"Domains\": [\"example.com\"],\n" +
+			"\"MaxUsers\": 10, \"Expires\": \"2030-01-01T00:00:00Z\"}), signed with\n" +
+			"ECDSA private key (e.g. openssl ecparam -name prime256v1 -genkey -noout -out key.pem).\n" +
+			"Use --trust to add public key to the trusted keys directory so that server accepts the key.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				claims = &Claims{}
+
+				keyFile, _ = cmd.Flags().GetString("key")
+				kid, _     = cmd.Flags().GetString("kid")
+				trust, _   = cmd.Flags().GetBool("trust")
+				keysDir, _ = cmd.Flags().GetString("keys-dir")
+			)
+
+			buf, err := readInput(args[0])
+			cli.HandleError(errors.Wrap(err, "could not read claims"))
+			cli.HandleError(errors.Wrap(json.Unmarshal(buf, claims), "could not decode claims"))
+
+			if claims.IssuedAt == 0 {
+				claims.IssuedAt = now().Unix()
+			}
+
+			key, err := readPrivateKey(keyFile)
+			cli.HandleError(err)
+
+			token, err := Sign(claims, kid, key)
+			cli.HandleError(err)
+
+			if trust {
+				path, err := writeTrustedKey(keysDir, kid, &key.PublicKey)
+				cli.HandleError(err)
+				cmd.Printf("Public key written to %s\n", path)
+			}
+
+			cmd.Println(token)
+		},
+	}
+
+	cmd.Flags().String("key", "", "PEM encoded ECDSA private key")
+	cmd.Flags().String("kid", "local", "Key ID, public key is trusted under this name")
+	cmd.Flags().Bool("trust", false, "Write public key to the trusted keys directory")
+	cmd.Flags().String("keys-dir", opt.KeysDir, "Trusted keys directory")
+	_ = cmd.MarkFlagRequired("key")
+
+	return cmd
+}
@@ -0,0 +1,137 @@
+package subscription
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	// Specificity of exact domain patterns, longer than any domain
+	exactDomainMatch = 1 << 16
+)
+
+// Returns domain the request was made to
+//
+// X-Forwarded-Host header is used only when request comes from one of the trusted proxies
+// (SUBSCRIPTION_TRUSTED_PROXIES). Request's remote address is replaced by the client
+// controlled X-Real-IP or X-Forwarded-For value (RealIP middleware) when we get to it;
+// proxy is checked against the address of the connected peer (see Serve) instead.
+func requestDomain(r *http.Request) string {
+	var host = r.Host
+
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" && isTrustedProxy(peerAddress(r.Context())) {
+		// Use the first (client facing) host when there are multiple proxies
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+
+	return normalizeDomain(host)
+}
+
+// Checks if address (with or w/o port) belongs to one of the trusted proxies
+func isTrustedProxy(addr string) bool {
+	if len(opt.TrustedProxies) == 0 {
+		return false
+	}
+
+	var ip = net.ParseIP(stripPort(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, p := range opt.TrustedProxies {
+		if _, cidr, err := net.ParseCIDR(p); err == nil && cidr.Contains(ip) {
+			return true
+		}
+
+		if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Normalizes domain or host for comparison
+//
+// Strips port and trailing dot, lower-cases name and converts IDN to punycode.
+// IP addresses (v4 and v6, with or w/o brackets) are converted to their canonical form.
+func normalizeDomain(host string) string {
+	host = strings.TrimSpace(stripPort(host))
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+
+	return host
+}
+
+// Removes port and IPv6 brackets from the host
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Matches domain against domain pattern
+//
+// Supported patterns:
+//   - "example.com"    matches only example.com
+//   - "*.example.com"  matches any subdomain of example.com, but not example.com itself
+//   - ".example.com"   matches example.com and any of its subdomains
+//   - "*"              matches any domain
+func matchDomain(pattern, domain string) bool {
+	pattern = strings.TrimSpace(pattern)
+	domain = normalizeDomain(domain)
+
+	switch {
+	case pattern == "*":
+		return true
+
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(domain, "."+normalizeDomain(pattern[2:]))
+
+	case strings.HasPrefix(pattern, "."):
+		base := normalizeDomain(pattern[1:])
+		return domain == base || strings.HasSuffix(domain, "."+base)
+
+	default:
+		return domain == normalizeDomain(pattern)
+	}
+}
+
+// Returns how specific is the domain pattern that matches domain, -1 when it does not match
+//
+// Exact domain is more specific than any wildcard; wildcard of a longer
+// domain is more specific than wildcard of a shorter one and "*" is the least specific.
+func domainSpecificity(pattern, domain string) int {
+	if !matchDomain(pattern, domain) {
+		return -1
+	}
+
+	pattern = strings.TrimSpace(pattern)
+
+	switch {
+	case pattern == "*":
+		return 0
+
+	case strings.HasPrefix(pattern, "*."):
+		return len(normalizeDomain(pattern[2:]))
+
+	case strings.HasPrefix(pattern, "."):
+		return len(normalizeDomain(pattern[1:]))
+
+	default:
+		return exactDomainMatch
+	}
+}
@@ -0,0 +1,72 @@
+package subscription
+
+import (
+	"testing"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:8080", "example.com"},
+		{" example.com ", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"127.0.0.1:80", "127.0.0.1"},
+		{"[::1]", "::1"},
+		{"[::1]:443", "::1"},
+		{"0:0:0:0:0:0:0:1", "::1"},
+		{"[2001:DB8::1]", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeDomain(tt.host); got != tt.want {
+			t.Errorf("normalizeDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		pattern string
+		domain  string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com:443", true},
+		{"example.com", "example.com.", true},
+		{"example.com", "www.example.com", false},
+		{"example.com", "notexample.com", false},
+
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "wwwexample.com", false},
+
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "notexample.com", false},
+
+		{"*", "anything.test", true},
+		{"*", "10.0.0.1", true},
+
+		{"bücher.example", "xn--bcher-kva.example", true},
+		{"*.Bücher.example", "shop.BÜCHER.example", true},
+
+		{"::1", "[::1]:8080", true},
+		{"127.0.0.1", "127.0.0.1:80", true},
+		{"127.0.0.1", "127.0.0.2", false},
+
+		{" example.com ", "example.com", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchDomain(tt.pattern, tt.domain); got != tt.want {
+			t.Errorf("matchDomain(%q, %q) = %v, want %v", tt.pattern, tt.domain, got, tt.want)
+		}
+	}
+}
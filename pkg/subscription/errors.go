@@ -0,0 +1,112 @@
+package subscription
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/titpetric/factory/resputil"
+)
+
+type (
+	// Error is a machine readable subscription error (or warning)
+	//
+	// Message holds human readable text, frontend should decide how to
+	// present it by looking at code, severity and audience.
+	Error struct {
+		Code     string            `json:"code"`
+		Severity string            `json:"severity"`
+		Audience string            `json:"audience"`
+		Params   map[string]string `json:"params,omitempty"`
+		Message  string            `json:"message"`
+	}
+
+	// Message code, severity and audience
+	//
+	// Message templates are kept in the catalogue, under the same code
+	message struct {
+		code     string
+		severity string
+		audience string
+	}
+)
+
+// How serious is the error
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityBlocking = "blocking"
+)
+
+// Who should see the error
+const (
+	AudienceAdmin    = "admin"
+	AudienceEveryone = "everyone"
+)
+
+// Error codes
+const (
+	ErrCodeWillExpire      = "will-expire"
+	ErrCodeExpired         = "expired"
+	ErrCodeTrialWillExpire = "trial-will-expire"
+	ErrCodeTrialExpired    = "trial-expired"
+	ErrCodeInvalidKey      = "invalid-key"
+	ErrCodeTrialUserLimit  = "trial-user-limit"
+	ErrCodeUserLimit       = "user-limit"
+	ErrCodeSignupDisabled  = "signup-disabled"
+	ErrCodeNotEntitled     = "not-entitled"
+	ErrCodeTrialQuota      = "trial-quota"
+	ErrCodeQuota           = "quota"
+	ErrCodeReadOnly        = "read-only"
+	ErrCodeSessionLimit    = "session-limit"
+	ErrCodeSessionEvicted  = "session-evicted"
+)
+
+// See subscription struct's functions on how & where these messages are used
+var (
+	willExpire      = message{ErrCodeWillExpire, SeverityInfo, AudienceAdmin}
+	hasExpired      = message{ErrCodeExpired, SeverityWarning, AudienceEveryone}
+	trialWillExpire = message{ErrCodeTrialWillExpire, SeverityWarning, AudienceEveryone}
+	trialHasExpired = message{ErrCodeTrialExpired, SeverityWarning, AudienceEveryone}
+	invalidKey      = message{ErrCodeInvalidKey, SeverityBlocking, AudienceEveryone}
+
+	trialAddUserError = message{ErrCodeTrialUserLimit, SeverityBlocking, AudienceAdmin}
+	addUserError      = message{ErrCodeUserLimit, SeverityBlocking, AudienceAdmin}
+	signupError       = message{ErrCodeSignupDisabled, SeverityBlocking, AudienceEveryone}
+
+	notEntitledError = message{ErrCodeNotEntitled, SeverityBlocking, AudienceEveryone}
+
+	trialQuotaError = message{ErrCodeTrialQuota, SeverityBlocking, AudienceEveryone}
+	quotaError      = message{ErrCodeQuota, SeverityBlocking, AudienceEveryone}
+
+	readOnlyError = message{ErrCodeReadOnly, SeverityBlocking, AudienceEveryone}
+
+	sessionLimitError   = message{ErrCodeSessionLimit, SeverityBlocking, AudienceEveryone}
+	sessionEvictedError = message{ErrCodeSessionEvicted, SeverityBlocking, AudienceEveryone}
+)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Localize returns copy of the error with message in the given language
+func (e *Error) Localize(lang string) *Error {
+	var l = *e
+	l.Message = render(lang, e.Code, e.Params)
+	return &l
+}
+
+// Writes error as JSON response
+//
+// Subscription errors are written with all their fields, under the same
+// "error" key as any other error and with message in the request's language
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(*Error); ok {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Error *Error `json:"error"`
+		}{e.Localize(requestLanguage(r))})
+		return
+	}
+
+	resputil.JSON(w, err)
+}
@@ -0,0 +1,269 @@
+package subscription
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/sentry"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// EventType identifies subscription state change, see Event* constants
+	EventType string
+
+	// Event describes subscription state change
+	Event struct {
+		Type EventType
+		Time time.Time
+
+		// Subscription after the change, nil when subscription is invalid
+		Claims *Claims
+
+		// Features added to and removed from subscription, set on EventEntitlementsChanged;
+		// subscription w/o any entitlements includes all features
+		Added   []string
+		Removed []string
+	}
+
+	// Listener is called (in its own goroutine) for each event it is subscribed to
+	Listener func(Event)
+
+	listener struct {
+		fn    Listener
+		types map[EventType]bool
+	}
+
+	// Subscription state as seen by listeners
+	subscriptionState struct {
+		valid          bool
+		warning        bool
+		expired        bool
+		readOnly       bool
+		seatsExhausted bool
+
+		// Sorted, nil when all features are included
+		entitlements []string
+	}
+
+	eventBus struct {
+		sync.Mutex
+
+		nextID    int
+		listeners map[int]listener
+
+		// Last published state, nil before the first publish
+		last *subscriptionState
+	}
+)
+
+// Subscription state changes
+//
+// Events are published on transitions only; the first publish
+// after start reports the initial state (became-valid, expired...)
+const (
+	EventBecameValid          EventType = "became-valid"
+	EventBecameInvalid        EventType = "became-invalid"
+	EventEnteredWarningWindow EventType = "entered-warning-window"
+	EventExpired              EventType = "expired"
+	EventReadOnly             EventType = "read-only"
+	EventSeatsExhausted       EventType = "seats-exhausted"
+	EventEntitlementsChanged  EventType = "entitlements-changed"
+)
+
+var (
+	bus = &eventBus{listeners: map[int]listener{}}
+)
+
+// Subscribe registers listener for the given event types (all events when none are given)
+//
+// Returned function removes the listener
+func Subscribe(fn Listener, types ...EventType) (unsubscribe func()) {
+	var l = listener{fn: fn}
+
+	if len(types) > 0 {
+		l.types = make(map[EventType]bool)
+		for _, t := range types {
+			l.types[t] = true
+		}
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+
+	id := bus.nextID
+	bus.nextID++
+	bus.listeners[id] = l
+
+	return func() {
+		bus.Lock()
+		defer bus.Unlock()
+		delete(bus.listeners, id)
+	}
+}
+
+// Compares current subscription state with the last published one
+// and notifies listeners about the changes
+//
+// Called on every subscription update and periodically by the watcher
+// (for changes that come with time, like expiration)
+func publishState(ctx context.Context) {
+	s, ok := service.CurrentSubscription.(*subscription)
+	if !ok {
+		return
+	}
+
+	var (
+		st, err = s.state(ctx)
+		claims  = s.claims()
+		ee      []Event
+	)
+
+	bus.Lock()
+	if bus.last == nil {
+		// Initial state; report either became-valid or became-invalid
+		bus.last = &subscriptionState{valid: !st.valid}
+	}
+
+	if err != nil {
+		// Seats can not be counted, keep the last known state
+		logger.Warn("could not count subscription seats", zap.Error(err))
+		st.seatsExhausted = bus.last.seatsExhausted
+	}
+
+	ee = st.changes(bus.last)
+	bus.last = st
+	bus.Unlock()
+
+	for _, e := range ee {
+		e.Time = now()
+		e.Claims = claims
+		bus.publish(e)
+	}
+}
+
+// Calls all listeners subscribed to the event
+func (b *eventBus) publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	logger.Debug("subscription event", zap.String("type", string(e.Type)))
+
+	for _, l := range b.listeners {
+		if l.types != nil && !l.types[e.Type] {
+			continue
+		}
+
+		go func(fn Listener) {
+			defer sentry.Recover()
+			fn(e)
+		}(l.fn)
+	}
+}
+
+// Returns current state of the subscription
+//
+// When seats can not be counted, error is returned with the state;
+// seatsExhausted is not set then
+func (s *subscription) state(ctx context.Context) (*subscriptionState, error) {
+	var used, err = s.seatsUsed(ctx)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var (
+		daysLeft = Claims{Expires: s.expires}.DaysLeft()
+		warnDays = warnAdminDaysLimit
+		st       = &subscriptionState{valid: s.isValid}
+	)
+
+	if !s.isValid {
+		return st, nil
+	}
+
+	if s.isTrial {
+		warnDays = warnTrialDaysLimit
+	}
+
+	st.expired = daysLeft <= 0
+	st.warning = !st.expired && daysLeft <= warnDays
+	st.readOnly = s.isReadOnly()
+	st.seatsExhausted = err == nil && s.limitMaxUsers > 0 && used >= s.limitMaxUsers
+
+	if s.entitlements != nil {
+		st.entitlements = make([]string, 0, len(s.entitlements))
+		for e := range s.entitlements {
+			st.entitlements = append(st.entitlements, e)
+		}
+
+		sort.Strings(st.entitlements)
+	}
+
+	return st, err
+}
+
+// Returns events for transitions from the previous state
+func (st *subscriptionState) changes(prev *subscriptionState) (ee []Event) {
+	var rising = []struct {
+		prev, curr bool
+		event      EventType
+	}{
+		{prev.valid, st.valid, EventBecameValid},
+		{!prev.valid, !st.valid, EventBecameInvalid},
+		{prev.warning, st.warning, EventEnteredWarningWindow},
+		{prev.expired, st.expired, EventExpired},
+		{prev.readOnly, st.readOnly, EventReadOnly},
+		{prev.seatsExhausted, st.seatsExhausted, EventSeatsExhausted},
+	}
+
+	for _, r := range rising {
+		if !r.prev && r.curr {
+			ee = append(ee, Event{Type: r.event})
+		}
+	}
+
+	if prev.valid && st.valid && !equalStrings(prev.entitlements, st.entitlements) {
+		ee = append(ee, Event{
+			Type:    EventEntitlementsChanged,
+			Added:   subtractStrings(st.entitlements, prev.entitlements),
+			Removed: subtractStrings(prev.entitlements, st.entitlements),
+		})
+	}
+
+	return
+}
+
+// Compares lists, nil list differs from empty one
+func equalStrings(a, b []string) bool {
+	if (a == nil) != (b == nil) || len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns values from a that are not in b
+func subtractStrings(a, b []string) (out []string) {
+	var in = make(map[string]bool, len(b))
+	for _, v := range b {
+		in[v] = true
+	}
+
+	for _, v := range a {
+		if !in[v] {
+			out = append(out, v)
+		}
+	}
+
+	return
+}
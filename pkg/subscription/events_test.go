@@ -0,0 +1,96 @@
+package subscription
+
+import (
+	"testing"
+)
+
+func TestSubscriptionStateChanges(t *testing.T) {
+	type (
+		st = subscriptionState
+	)
+
+	var (
+		valid = st{valid: true}
+	)
+
+	tests := []struct {
+		name    string
+		prev    st
+		curr    st
+		want    []EventType
+		added   []string
+		removed []string
+	}{
+		{"no change", valid, valid, nil, nil, nil},
+		{"initial valid", st{valid: false}, valid, []EventType{EventBecameValid}, nil, nil},
+		{"initial invalid", st{valid: true}, st{valid: false}, []EventType{EventBecameInvalid}, nil, nil},
+		{"initial expired", st{valid: false}, st{valid: true, expired: true, readOnly: true}, []EventType{EventBecameValid, EventExpired, EventReadOnly}, nil, nil},
+		{"entered warning window", valid, st{valid: true, warning: true}, []EventType{EventEnteredWarningWindow}, nil, nil},
+		{"still in warning window", st{valid: true, warning: true}, st{valid: true, warning: true}, nil, nil, nil},
+		{"expired", st{valid: true, warning: true}, st{valid: true, expired: true}, []EventType{EventExpired}, nil, nil},
+		{"read-only", st{valid: true, expired: true}, st{valid: true, expired: true, readOnly: true}, []EventType{EventReadOnly}, nil, nil},
+		{"renewed", st{valid: true, expired: true, readOnly: true}, valid, nil, nil, nil},
+		{"seats exhausted", valid, st{valid: true, seatsExhausted: true}, []EventType{EventSeatsExhausted}, nil, nil},
+		{"seats freed", st{valid: true, seatsExhausted: true}, valid, nil, nil, nil},
+		{"invalidated", st{valid: true, warning: true, entitlements: []string{"compose"}}, st{valid: false}, []EventType{EventBecameInvalid}, nil, nil},
+		{
+			"features added",
+			st{valid: true, entitlements: []string{"compose"}},
+			st{valid: true, entitlements: []string{"compose", "messaging"}},
+			[]EventType{EventEntitlementsChanged},
+			[]string{"messaging"},
+			nil,
+		},
+		{
+			"features replaced",
+			st{valid: true, entitlements: []string{"automation", "compose"}},
+			st{valid: true, entitlements: []string{"compose", "messaging"}},
+			[]EventType{EventEntitlementsChanged},
+			[]string{"messaging"},
+			[]string{"automation"},
+		},
+		{
+			"all features included",
+			st{valid: true, entitlements: []string{"compose"}},
+			valid,
+			[]EventType{EventEntitlementsChanged},
+			nil,
+			[]string{"compose"},
+		},
+		{
+			"no features included",
+			valid,
+			st{valid: true, entitlements: []string{}},
+			[]EventType{EventEntitlementsChanged},
+			nil,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				curr = tt.curr
+				ee   = curr.changes(&tt.prev)
+			)
+
+			if len(ee) != len(tt.want) {
+				t.Fatalf("changes() = %v, want %v", ee, tt.want)
+			}
+
+			for i, e := range ee {
+				if e.Type != tt.want[i] {
+					t.Errorf("changes()[%d].Type = %s, want %s", i, e.Type, tt.want[i])
+				}
+
+				if e.Type != EventEntitlementsChanged {
+					continue
+				}
+
+				if !equalStrings(e.Added, tt.added) || !equalStrings(e.Removed, tt.removed) {
+					t.Errorf("changes()[%d] added %v, removed %v; want added %v, removed %v", i, e.Added, e.Removed, tt.added, tt.removed)
+				}
+			}
+		})
+	}
+}
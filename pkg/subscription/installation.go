@@ -0,0 +1,233 @@
+package subscription
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+)
+
+const (
+	settingInstallationKey = "crust-subscription.installation.key"
+	settingInstallationID  = "crust-subscription.installation.id"
+
+	// Name of the database lock that serializes creation of installation ID, key and trial
+	installationLockName = "crust-subscription.installation"
+)
+
+// Returns ID of this installation, generates one if it does not exist yet
+//
+// Second return value is true when ID was generated by this call
+// (fresh installation or first run of a version that knows about IDs)
+func installationID(ctx context.Context) (string, bool, error) {
+	if id, err := loadInstallationID(ctx); err != nil || id != "" {
+		return id, false, err
+	}
+
+	release, err := lockInstallation(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	defer release()
+	return createInstallationID(ctx)
+}
+
+// Takes installation lock
+//
+// All services (system, compose, messaging) and their replicas start at the
+// same time on the first boot; lock makes sure only one of them creates
+// installation ID, key and trial.
+func lockInstallation(ctx context.Context) (release func(), err error) {
+	release, err = lockDB(ctx, installationLockName, opt.LockTimeout)
+	return release, errors.Wrap(err, "could not lock installation")
+}
+
+// Loads ID of this installation, empty when it does not exist yet
+func loadInstallationID(ctx context.Context) (string, error) {
+	if settingsSvc == nil {
+		return "", errors.New("no settings service")
+	}
+
+	v, err := settingsSvc.Get(auth.SetSuperUserContext(ctx), settingInstallationID, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "could not load installation ID")
+	}
+
+	return v.String(), nil
+}
+
+// Generates ID of this installation unless it was created in the meantime
+//
+// Expects installation lock to be held
+func createInstallationID(ctx context.Context) (string, bool, error) {
+	ctx = auth.SetSuperUserContext(ctx)
+
+	if id, err := loadInstallationID(ctx); err != nil || id != "" {
+		return id, false, err
+	}
+
+	var b = make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, errors.Wrap(err, "could not generate installation ID")
+	}
+
+	// Random (v4) UUID
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	v := &settings.Value{Name: settingInstallationID}
+	_ = v.SetValue(id)
+	if err := settingsSvc.Set(ctx, v); err != nil {
+		return "", false, errors.Wrap(err, "could not save installation ID")
+	}
+
+	// Read back what was stored
+	saved, err := loadInstallationID(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	if saved != id {
+		return saved, false, nil
+	}
+
+	logger.Info("installation ID generated", zap.String("installation-id", id))
+	return id, true, nil
+}
+
+// InstallationID returns ID of this installation, generates one if it does not exist yet
+//
+// ID is sent when ordering a subscription and can be included in subscription claims
+func InstallationID(ctx context.Context) (string, error) {
+	id, _, err := installationID(ctx)
+	return id, err
+}
+
+// Checks if subscription is issued for this installation
+//
+// Subscriptions w/o installation IDs are valid for any installation;
+// when installation ID can not be loaded transientError is returned
+func checkInstallation(ctx context.Context, c *Claims) error {
+	if len(c.Installations) == 0 {
+		return nil
+	}
+
+	id, _, err := installationID(ctx)
+	if err != nil {
+		return transientError{err}
+	}
+
+	return matchInstallation(c, id)
+}
+
+// Checks if subscription is issued for the installation with the given ID
+func matchInstallation(c *Claims, id string) error {
+	if len(c.Installations) == 0 {
+		return nil
+	}
+
+	for _, i := range c.Installations {
+		if id != "" && strings.EqualFold(i, id) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("subscription is not issued for this installation (%s)", id)
+}
+
+// Returns private key of this installation, generates one if it does not exist yet
+//
+// Key is used for signing documents (usage reports...) that
+// leave this installation
+func installationKey(ctx context.Context) (*ecdsa.PrivateKey, error) {
+	if key, err := loadInstallationKey(ctx); err != nil || key != nil {
+		return key, err
+	}
+
+	release, err := lockInstallation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	// Another service (or replica) could create it while we waited for the lock
+	if key, err := loadInstallationKey(ctx); err != nil || key != nil {
+		return key, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate installation key")
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &settings.Value{Name: settingInstallationKey}
+	_ = v.SetValue(string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	if err = settingsSvc.Set(auth.SetSuperUserContext(ctx), v); err != nil {
+		return nil, errors.Wrap(err, "could not save installation key")
+	}
+
+	logger.Info("installation key generated")
+	return loadInstallationKey(ctx)
+}
+
+// InstallationPublicKey returns public key of this installation (PEM encoded),
+// generates installation key if it does not exist yet
+//
+// Usage reports are signed with installation key; public key is to be recorded
+// together with the installation ID so that reports can be traced back to
+// the installation (see SignedUsageReport.Verify)
+func InstallationPublicKey(ctx context.Context) (string, error) {
+	key, err := installationKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return encodePublicKey(&key.PublicKey)
+}
+
+// Loads private key of this installation, nil when it does not exist yet
+func loadInstallationKey(ctx context.Context) (*ecdsa.PrivateKey, error) {
+	if settingsSvc == nil {
+		return nil, errors.New("no settings service")
+	}
+
+	v, err := settingsSvc.Get(auth.SetSuperUserContext(ctx), settingInstallationKey, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load installation key")
+	}
+
+	if v.String() == "" {
+		return nil, nil
+	}
+
+	return jwt.ParseECPrivateKeyFromPEM([]byte(v.String()))
+}
+
+// Encodes public key in PEM format
+func encodePublicKey(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
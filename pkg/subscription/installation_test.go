@@ -0,0 +1,50 @@
+package subscription
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckInstallation(t *testing.T) {
+	const iid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+
+	_, restoreLocks := useTestLocks()
+	defer restoreLocks()
+
+	tests := []struct {
+		name          string
+		installed     string
+		installations []string
+		valid         bool
+	}{
+		{"not bound", iid, nil, true},
+		{"not bound, no installation ID", "", nil, true},
+		{"this installation", iid, []string{"other", iid}, true},
+		{"this installation, upper case", iid, []string{"7C9E6679-7425-40DE-944B-E07FC1F90AE7"}, true},
+		{"other installation", iid, []string{"other"}, false},
+		{"no installation ID", "", []string{iid}, false},
+	}
+
+	for _, tt := range tests {
+		ts, restore := useTestSettings(nil)
+		if tt.installed != "" {
+			ts.vv[settingInstallationID] = tt.installed
+		}
+
+		err := checkInstallation(context.Background(), &Claims{Installations: tt.installations})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: checkInstallation() = %v, want valid: %v", tt.name, err, tt.valid)
+		}
+
+		if isTransient(err) {
+			t.Errorf("%s: checkInstallation() = %v, want permanent error", tt.name, err)
+		}
+
+		// Installation ID is generated only when key is bound to installations
+		if generated := ts.vv[settingInstallationID] != ""; tt.installed == "" && generated != (len(tt.installations) > 0) {
+			t.Errorf("%s: installation ID generated: %v", tt.name, generated)
+		}
+
+		restore()
+	}
+}
@@ -0,0 +1,298 @@
+package subscription
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+)
+
+type (
+	// Set of trusted public keys (by key ID) and list of revoked subscriptions
+	keyring struct {
+		sync.RWMutex
+
+		keys map[string]*ecdsa.PublicKey
+
+		// Raw revocation list value, kept for change detection
+		revocations string
+		revoked     map[string]bool
+
+		// Issue time of the applied revocation list; older lists are rejected
+		revocationsIssued int64
+	}
+
+	// Signed list of revoked subscription IDs (jti claim)
+	//
+	// Every list has an issue time (iat claim); list can only be
+	// replaced by one issued at the same time or later
+	revocationClaims struct {
+		Revoked  []string
+		IssuedAt int64 `json:"iat"`
+	}
+)
+
+const (
+	HEADER_TYPE_REVOCATIONS = "crust-subscription-revocations"
+
+	// ID of the built-in signing key; keys w/o kid header are verified with it
+	builtinKeyID = ""
+
+	// Extension of the public key files in keys directory (<kid>.pem)
+	keyFileExt = ".pem"
+)
+
+var (
+	trusted = newKeyring()
+)
+
+func (c revocationClaims) Valid() error {
+	var (
+		t    = now().Unix()
+		skew = int64(opt.ClockSkew / time.Second)
+	)
+
+	switch {
+	case c.IssuedAt == 0:
+		return errors.New("revocation list has no issue time")
+
+	case t+skew < c.IssuedAt:
+		return errors.Errorf("revocation list is issued in the future (%s)", time.Unix(c.IssuedAt, 0).Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Creates keyring with the built-in public key
+func newKeyring() *keyring {
+	kr := &keyring{
+		keys:    map[string]*ecdsa.PublicKey{},
+		revoked: map[string]bool{},
+	}
+
+	if err := kr.add(builtinKeyID, publicKey); err != nil {
+		panic(err)
+	}
+
+	return kr
+}
+
+// Resets keyring to built-in key and adds all keys from the configured keys directory
+func initKeyring() {
+	trusted = newKeyring()
+
+	if opt.KeysDir == "" {
+		return
+	}
+
+	if err := trusted.addDir(opt.KeysDir); err != nil {
+		logger.Error("could not load trusted keys", zap.String("dir", opt.KeysDir), zap.Error(err))
+	}
+}
+
+// Adds PEM encoded ECDSA public key under the given key ID
+func (kr *keyring) add(kid string, pem []byte) error {
+	key, err := jwt.ParseECPublicKeyFromPEM(pem)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse public key %q", kid)
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+	kr.keys[kid] = key
+	return nil
+}
+
+// Adds all public keys from a directory; file name (w/o .pem) is used as key ID
+func (kr *keyring) addDir(dir string) error {
+	ff, err := filepath.Glob(filepath.Join(dir, "*"+keyFileExt))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range ff {
+		var (
+			kid = strings.TrimSuffix(filepath.Base(f), keyFileExt)
+			pem []byte
+		)
+
+		if kid == builtinKeyID {
+			continue
+		}
+
+		if pem, err = ioutil.ReadFile(f); err != nil {
+			return err
+		}
+
+		if err = kr.add(kid, pem); err != nil {
+			return err
+		}
+
+		logger.Info("trusted key added", zap.String("kid", kid))
+	}
+
+	return nil
+}
+
+// Selects public key by token's kid header
+//
+// Satisfies jwt.Keyfunc
+func (kr *keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	var kid, _ = token.Header["kid"].(string)
+
+	kr.RLock()
+	defer kr.RUnlock()
+
+	if key, ok := kr.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errors.Errorf("unknown signing key %q", kid)
+}
+
+// Verifies and applies signed revocation list
+//
+// Empty list and list issued before the applied one are rejected
+func (kr *keyring) setRevocations(raw string) error {
+	if raw == "" {
+		return errors.New("revocation list is empty")
+	}
+
+	var (
+		claims  = &revocationClaims{}
+		revoked = map[string]bool{}
+	)
+
+	token, err := jwt.ParseWithClaims(raw, claims, kr.keyFunc)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse revocation list")
+	}
+
+	if !token.Valid || token.Header["type"] != HEADER_TYPE_REVOCATIONS {
+		return errors.New("invalid revocation list")
+	}
+
+	for _, id := range claims.Revoked {
+		revoked[id] = true
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+
+	if claims.IssuedAt < kr.revocationsIssued {
+		return errors.Errorf(
+			"revocation list issued at %s is older than the applied one (%s)",
+			time.Unix(claims.IssuedAt, 0).Format(time.RFC3339),
+			time.Unix(kr.revocationsIssued, 0).Format(time.RFC3339),
+		)
+	}
+
+	kr.revocations = raw
+	kr.revoked = revoked
+	kr.revocationsIssued = claims.IssuedAt
+	return nil
+}
+
+// Returns true if revocation list differs from the one applied
+func (kr *keyring) revocationsChanged(raw string) bool {
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.revocations != raw
+}
+
+// Returns issue time of the applied revocation list, 0 when there is none
+func (kr *keyring) issued() int64 {
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.revocationsIssued
+}
+
+func (kr *keyring) isRevoked(id string) bool {
+	kr.RLock()
+	defer kr.RUnlock()
+	return id != "" && kr.revoked[id]
+}
+
+// Loads revocation list from settings and applies it when changed
+//
+// Invalid revocation list is ignored and the previous one is kept. Applied list
+// is stored and restored on start, before the list from settings is checked;
+// removing the list or replacing it with an older one has no effect.
+func loadRevocations(ctx context.Context) (changed bool, err error) {
+	return readRevocations(ctx, true)
+}
+
+// Loads revocation list from settings, same as loadRevocations,
+// but does not store the applied list
+func peekRevocations(ctx context.Context) error {
+	_, err := readRevocations(ctx, false)
+	return err
+}
+
+func readRevocations(ctx context.Context, store bool) (changed bool, err error) {
+	if settingsSvc == nil {
+		return false, nil
+	}
+
+	ctx = auth.SetSuperUserContext(ctx)
+
+	v, err := settingsSvc.Get(ctx, settingSubscriptionRevocationsKey, 0)
+	if err != nil {
+		return false, err
+	}
+
+	a, err := settingsSvc.Get(ctx, settingSubscriptionRevocationsAppliedKey, 0)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		raw     = v.String()
+		applied = a.String()
+	)
+
+	if raw == "" && applied == "" {
+		// No revocation list was ever installed
+		return false, nil
+	}
+
+	if applied != "" && trusted.issued() == 0 {
+		// Restore applied list first (on start), list from settings
+		// is compared against it
+		if err = trusted.setRevocations(applied); err != nil {
+			logger.Warn("could not restore applied subscription revocation list", zap.Error(err))
+		} else {
+			changed = true
+		}
+	}
+
+	if raw == "" || !trusted.revocationsChanged(raw) {
+		// List was removed (applied one is kept) or it did not change
+		return changed, nil
+	}
+
+	if err = trusted.setRevocations(raw); err != nil {
+		return changed, err
+	}
+
+	if store && raw != applied {
+		a = &settings.Value{Name: settingSubscriptionRevocationsAppliedKey}
+		_ = a.SetValue(raw)
+		if err = settingsSvc.Set(ctx, a); err != nil {
+			logger.Warn("could not store applied subscription revocation list", zap.Error(err))
+		}
+	}
+
+	logger.Info("subscription revocation list updated")
+	return true, nil
+}
@@ -0,0 +1,294 @@
+package subscription
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+)
+
+type (
+	// In-memory settings (global ones only)
+	//
+	// Objects are kept as JSON, other values as strings
+	testSettings struct {
+		sync.Mutex
+		vv map[string]string
+	}
+)
+
+const (
+	testKeyID = "test"
+)
+
+var (
+	testKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func (ts *testSettings) FindByPrefix(_ context.Context, pp ...string) (out settings.ValueSet, err error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	for name, v := range ts.vv {
+		for _, p := range pp {
+			if strings.HasPrefix(name, p) {
+				out = append(out, ts.value(name, v))
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func (ts *testSettings) Get(_ context.Context, name string, ownedBy uint64) (*settings.Value, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if v, ok := ts.vv[name]; ok && ownedBy == 0 {
+		return ts.value(name, v), nil
+	}
+
+	return nil, nil
+}
+
+func (ts *testSettings) Set(_ context.Context, v *settings.Value) error {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if raw := string(v.Value); strings.HasPrefix(raw, "{") {
+		ts.vv[v.Name] = raw
+	} else {
+		ts.vv[v.Name] = v.String()
+	}
+
+	return nil
+}
+
+func (ts *testSettings) Delete(_ context.Context, name string, _ uint64) error {
+	ts.Lock()
+	defer ts.Unlock()
+	delete(ts.vv, name)
+	return nil
+}
+
+func (ts *testSettings) value(name, v string) *settings.Value {
+	var out = &settings.Value{Name: name}
+	if strings.HasPrefix(v, "{") {
+		out.Value = []byte(v)
+	} else {
+		_ = out.SetValue(v)
+	}
+
+	return out
+}
+
+// Replaces settings service and keyring (with test key trusted),
+// returns function that restores them
+func useTestSettings(vv map[string]string) (*testSettings, func()) {
+	var (
+		prevSettings = settingsSvc
+		prevKeyring  = trusted
+		ts           = &testSettings{vv: vv}
+	)
+
+	if ts.vv == nil {
+		ts.vv = map[string]string{}
+	}
+
+	settingsSvc = ts
+	restartKeyring()
+
+	return ts, func() {
+		settingsSvc = prevSettings
+		trusted = prevKeyring
+	}
+}
+
+// Fresh keyring, as on server start
+func restartKeyring() {
+	trusted = newKeyring()
+	if err := trusted.add(testKeyID, []byte(mustEncodePublicKey(&testKey.PublicKey))); err != nil {
+		panic(err)
+	}
+}
+
+func mustEncodePublicKey(key *ecdsa.PublicKey) string {
+	pem, err := encodePublicKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return pem
+}
+
+// Signs token with the test key
+func testSign(claims jwt.Claims, typ string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["type"] = typ
+	token.Header["kid"] = testKeyID
+
+	signed, err := token.SignedString(testKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return signed
+}
+
+func testRevocations(issued time.Time, ids ...string) string {
+	return testSign(revocationClaims{Revoked: ids, IssuedAt: issued.Unix()}, HEADER_TYPE_REVOCATIONS)
+}
+
+func TestSetRevocations(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+	opt.ClockSkew = 5 * time.Minute
+
+	tests := []struct {
+		name    string
+		raw     string
+		revoked bool
+		valid   bool
+	}{
+		{"empty", "", false, false},
+		{"garbage", "not a token", false, false},
+		{"same time", testRevocations(at.Add(-time.Hour), "jti"), true, true},
+		{"newer", testRevocations(at, "jti"), true, true},
+		{"older", testRevocations(at.Add(-2*time.Hour), "jti"), false, false},
+		{"issued in future", testRevocations(at.Add(time.Hour), "jti"), false, false},
+		{"no issue time", testSign(revocationClaims{Revoked: []string{"jti"}}, HEADER_TYPE_REVOCATIONS), false, false},
+		{"subscription key", testSign(revocationClaims{Revoked: []string{"jti"}, IssuedAt: at.Unix()}, HEADER_TYPE), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var kr = newKeyring()
+			if err := kr.add(testKeyID, []byte(mustEncodePublicKey(&testKey.PublicKey))); err != nil {
+				t.Fatal(err)
+			}
+
+			// Applied list, issued hour ago
+			if err := kr.setRevocations(testRevocations(at.Add(-time.Hour))); err != nil {
+				t.Fatal(err)
+			}
+
+			err := kr.setRevocations(tt.raw)
+			if (err == nil) != tt.valid {
+				t.Errorf("setRevocations() = %v, want valid: %v", err, tt.valid)
+			}
+
+			if kr.isRevoked("jti") != tt.revoked {
+				t.Errorf("isRevoked() = %v, want %v", !tt.revoked, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestLoadRevocations(t *testing.T) {
+	var (
+		at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		older = testRevocations(at.Add(-2*time.Hour), "old")
+		newer = testRevocations(at.Add(-time.Hour), "new")
+	)
+
+	defer fixClock(at)()
+	opt.ClockSkew = 5 * time.Minute
+
+	tests := []struct {
+		name     string
+		list     string
+		applied  string
+		restart  bool
+		revoked  []string
+		valid    []string
+		stored   string
+		loadFail bool
+	}{
+		{name: "no list", valid: []string{"old", "new"}},
+		{name: "new list", list: newer, revoked: []string{"new"}, stored: newer},
+		{name: "unchanged list", list: newer, applied: newer, revoked: []string{"new"}, stored: newer},
+		{name: "newer list", list: newer, applied: older, revoked: []string{"new"}, valid: []string{"old"}, stored: newer},
+		{name: "removed list", applied: newer, revoked: []string{"new"}, stored: newer},
+		{name: "removed list, restart", applied: newer, restart: true, revoked: []string{"new"}, stored: newer},
+		{name: "older list", list: older, applied: newer, revoked: []string{"new"}, valid: []string{"old"}, stored: newer, loadFail: true},
+		{name: "older list, restart", list: older, applied: newer, restart: true, revoked: []string{"new"}, valid: []string{"old"}, stored: newer, loadFail: true},
+		{name: "invalid list", list: "not a token", applied: newer, revoked: []string{"new"}, stored: newer, loadFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, restore := useTestSettings(nil)
+			defer restore()
+
+			if tt.applied != "" {
+				// List was applied before
+				ts.vv[settingSubscriptionRevocationsKey] = tt.applied
+				if _, err := loadRevocations(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+
+				if tt.restart {
+					restartKeyring()
+				}
+			}
+
+			if tt.list == "" {
+				delete(ts.vv, settingSubscriptionRevocationsKey)
+			} else {
+				ts.vv[settingSubscriptionRevocationsKey] = tt.list
+			}
+
+			if _, err := loadRevocations(context.Background()); (err != nil) != tt.loadFail {
+				t.Errorf("loadRevocations() = %v, want failure: %v", err, tt.loadFail)
+			}
+
+			for _, id := range tt.revoked {
+				if !trusted.isRevoked(id) {
+					t.Errorf("subscription %q is not revoked", id)
+				}
+			}
+
+			for _, id := range tt.valid {
+				if trusted.isRevoked(id) {
+					t.Errorf("subscription %q is revoked", id)
+				}
+			}
+
+			if stored := ts.vv[settingSubscriptionRevocationsAppliedKey]; stored != tt.stored {
+				t.Errorf("stored applied list %.20q..., want %.20q...", stored, tt.stored)
+			}
+		})
+	}
+}
+
+func TestPeekRevocations(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	ts, restore := useTestSettings(map[string]string{
+		settingSubscriptionRevocationsKey: testRevocations(at, "jti"),
+	})
+	defer restore()
+
+	if err := peekRevocations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !trusted.isRevoked("jti") {
+		t.Errorf("subscription is not revoked")
+	}
+
+	if _, stored := ts.vv[settingSubscriptionRevocationsAppliedKey]; stored {
+		t.Errorf("peekRevocations() stored applied list")
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"github.com/cortezaproject/corteza-server/pkg/auth"
@@ -16,16 +17,36 @@ type (
 	// Interface to settings backend
 	//
 	// We are using settings backend for storing subscription key
-	//  - crust-subscription.jet
+	//  - crust-subscription.jwt
+	//  - crust-subscription.trial
+	//  - crust-subscription.organisation.<organisationID>.jwt
 	settingsGetterSetter interface {
+		FindByPrefix(context.Context, ...string) (settings.ValueSet, error)
 		Get(context.Context, string, uint64) (*settings.Value, error)
 		Set(context.Context, *settings.Value) error
+		Delete(context.Context, string, uint64) error
+	}
+
+	// Error that can go away on its own (database is not available,
+	// key is not valid yet...); key is checked again later
+	transientError struct {
+		error
 	}
 )
 
 const (
 	settingSubscriptionJwtKey   = "crust-subscription.jwt"
 	settingSubscriptionTrialKey = "crust-subscription.trial"
+
+	// Installation that generic trial record was first written for;
+	// plain trial date of older versions is accepted only before that
+	settingSubscriptionTrialRecordedKey = "crust-subscription.trial.recorded"
+
+	settingSubscriptionRevocationsKey = "crust-subscription.revocations"
+
+	// Last applied revocation list, restored on start so that
+	// an older list can not replace it
+	settingSubscriptionRevocationsAppliedKey = "crust-subscription.revocations.applied"
 )
 
 var (
@@ -39,6 +60,8 @@ SzbZ8RTdJSvY75iw0TI=
 -----END PUBLIC KEY-----`)
 
 	settingsSvc settingsGetterSetter
+
+	opt = Options()
 )
 
 // Init sets pkg basics: logger & settings interface
@@ -49,6 +72,9 @@ func Init(l *zap.Logger, ss settingsGetterSetter) {
 		// None of the logs at subscription pkg should be at DPanic or higher.
 		WithOptions(zap.AddStacktrace(zap.DPanicLevel))
 
+	opt = Options()
+	initKeyring()
+
 	if ss == nil {
 		logger.Error("could not load subscription settings, no settings service")
 		return
@@ -58,93 +84,372 @@ func Init(l *zap.Logger, ss settingsGetterSetter) {
 }
 
 func Load(ctx context.Context) *Claims {
-	ctx = auth.SetSuperUserContext(ctx)
+	if err := createTables(ctx); err != nil {
+		// Watcher tries again
+		logger.Error("could not create subscription tables", zap.Error(err))
+	}
 
-	if v, err := settingsSvc.Get(ctx, settingSubscriptionJwtKey, 0); err != nil {
-		logger.Error("could not load subscription JWT key", zap.Error(err))
+	if _, err := loadRevocations(ctx); err != nil {
+		logger.Error("could not load subscription revocation list", zap.Error(err))
+	}
+
+	if err := loadBranding(ctx); err != nil {
+		logger.Error("could not load subscription branding", zap.Error(err))
+	}
+
+	if err := loadTenants(ctx); err != nil {
+		logger.Error("could not load organisation subscriptions", zap.Error(err))
+	}
+
+	key, source, err := loadKey(ctx)
+	if err != nil {
+		logger.Error("could not load subscription JWT key", zap.String("source", source), zap.Error(err))
 		return nil
-	} else if v == nil || v.String() == "" {
+	}
+
+	setActiveSource(source)
+
+	if key == "" {
 		logger.Info("subscription value missing", zap.String("name", settingSubscriptionJwtKey))
-		return genericTrial(ctx)
-	} else {
-		return parse(v.String())
+
+		claims := genericTrial(ctx)
+		if claims != nil {
+			// Remember what we've loaded so that watcher
+			// can detect changes
+			watched.set(key)
+		}
+
+		return claims
+	}
+
+	// Make sure installation has an ID from the first boot on
+	// (trial creates it on its own)
+	if _, _, err = installationID(ctx); err != nil {
+		logger.Error("could not load installation ID", zap.Error(err))
+	}
+
+	claims, err := parseInstalled(ctx, key)
+	if isTransient(err) {
+		// Watcher will try again
+		logger.Error("could not check subscription", zap.String("source", source), zap.Error(err))
+		return nil
 	}
+
+	watched.set(key)
+
+	if err != nil {
+		// Same as when watcher finds invalid key
+		logger.Error("invalid subscription, resetting subscription", zap.String("source", source), zap.Error(err))
+		ResetCurrent()
+		return nil
+	}
+
+	return claims
 }
 
 // Parses subscription
-func parse(subval string) *Claims {
+func parse(subval string) (*Claims, error) {
 	var claims = &Claims{}
 
-	parsedToken, err := jwt.ParseWithClaims(subval, claims, func(token *jwt.Token) (i interface{}, err error) {
-		return jwt.ParseECPublicKeyFromPEM(publicKey)
-	})
+	parsedToken, err := jwt.ParseWithClaims(subval, claims, trusted.keyFunc)
 
 	if err != nil {
-		logger.Error("failed to parse subscription jwt", zap.Error(err))
-		return nil
+		return nil, errors.Wrap(err, "failed to parse subscription jwt")
 	}
 
 	if !parsedToken.Valid || parsedToken.Header["type"] != HEADER_TYPE {
-		logger.Error("invalid subscription jwt")
-		return nil
+		return nil, errors.New("invalid subscription jwt")
 	}
 
-	if err = claims.Valid(); err != nil {
-		logger.Error("invalid subscription", zap.Error(err))
-		return nil
+	claims.normalize()
+
+	if trusted.isRevoked(claims.ID) {
+		return nil, errors.Errorf("subscription %q has been revoked", claims.ID)
 	}
 
 	logger.Debug("subscription loaded")
 
-	return claims
+	return claims, nil
+}
+
+// Parses subscription and checks if it is issued for this installation
+//
+// Failures are recorded in the audit log, transient ones (see isTransient)
+// are not as they are retried
+func parseInstalled(ctx context.Context, subval string) (*Claims, error) {
+	claims, err := parse(subval)
+	if isTransient(err) {
+		return nil, err
+	} else if err != nil {
+		audit(ctx, AuditParseFailed, nil, err.Error())
+		return nil, err
+	}
+
+	if err = checkInstallation(ctx, claims); isTransient(err) {
+		return nil, err
+	} else if err != nil {
+		audit(ctx, AuditInstallationMismatch, claims, err.Error())
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Peek loads subscription like Load does but w/o changing anything
+//
+// Installation ID and trial are not created and failures are not
+// recorded in the audit log. Used by commands that only show subscription.
+func Peek(ctx context.Context) (*Claims, error) {
+	if err := peekRevocations(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not load subscription revocation list")
+	}
+
+	key, source, err := loadKey(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load subscription key (%s)", source)
+	}
+
+	setActiveSource(source)
+
+	if key == "" {
+		return peekTrial(ctx)
+	}
+
+	return peekKey(ctx, key)
+}
+
+// Parses subscription and checks if it is issued for this installation, same
+// as parseInstalled but w/o creating installation ID or recording failures
+func peekKey(ctx context.Context, key string) (*Claims, error) {
+	claims, err := parse(key)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := loadInstallationID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, matchInstallation(claims, id)
+}
+
+// Loads existing trial
+func peekTrial(ctx context.Context) (*Claims, error) {
+	ctx = auth.SetSuperUserContext(ctx)
+
+	iid, err := loadInstallationID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := settingsSvc.Get(ctx, settingSubscriptionTrialKey, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load subscription trial")
+	}
+
+	if iid == "" || v.String() == "" {
+		return nil, errors.New("subscription key not installed, trial not started yet")
+	}
+
+	trial, err := decodeTrialRecord(iid, v.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return trial.claims(), nil
+}
+
+// Checks if error can go away on its own and key should be checked again later
+//
+// Errors returned by Claims.Valid are wrapped by jwt
+func isTransient(err error) bool {
+	err = errors.Cause(err)
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Inner != nil {
+		err = errors.Cause(ve.Inner)
+	}
+
+	_, ok := err.(transientError)
+	return ok
 }
 
 // Generates trial if it does not exist yet
 //
-// this is a simple date entry in the setting table -- YYYY-MM-DD when
-// trial expires
+// Trial is stored as a MACed record, bound to the installation ID (see trialRecord).
+// When record is removed, modified or backdated we fall back to a trial that
+// has already expired.
 //
 // This function is called only when no (other) subscription key setting is found
 func genericTrial(ctx context.Context) *Claims {
-	const expDateFormat = "2006-01-02"
+	ctx = auth.SetSuperUserContext(ctx)
 
+	// Trial record is usually there already
+	if iid, err := loadInstallationID(ctx); err == nil && iid != "" {
+		if v, err := settingsSvc.Get(ctx, settingSubscriptionTrialKey, 0); err == nil {
+			if trial, err := decodeTrialRecord(iid, v.String()); err == nil {
+				return trial.claims()
+			}
+		}
+	}
+
+	// Trial is created (or replaced) by one service only, the others
+	// wait and load the trial it created
+	release, err := lockInstallation(ctx)
+	if err != nil {
+		logger.Error("could not load subscription trial", zap.Error(err))
+		return nil
+	}
+
+	defer release()
+	return issueTrial(ctx)
+}
+
+// Loads, creates or replaces tampered generic trial
+//
+// Expects installation lock to be held
+func issueTrial(ctx context.Context) *Claims {
 	var (
 		saveTrial bool
-		expDate   time.Time
+		trial     *trialRecord
+		tampered  error
 	)
 
-	ctx = auth.SetSuperUserContext(ctx)
+	iid, isNewInstallation, err := createInstallationID(ctx)
+	if err != nil {
+		logger.Error("could not load subscription trial", zap.Error(err))
+		return nil
+	}
 
-	if v, err := settingsSvc.Get(ctx, settingSubscriptionTrialKey, 0); err != nil {
+	v, err := settingsSvc.Get(ctx, settingSubscriptionTrialKey, 0)
+	if err != nil {
 		logger.Error("could not load subscription trial", zap.Error(err))
 		return nil
-	} else if v != nil || v.String() != "" {
+	}
+
+	if enc := v.String(); enc != "" {
 		logger.Info("generic trial key found")
 
-		// Trial exp. date found
-		expDate, err = time.Parse(expDateFormat, v.String())
-		if err != nil {
-			// If we can not parse the trial exp. date, assume it expired today.
-			expDate = time.Date(now().Year(), now().Month(), now().Day(), 0, 0, 0, 0, now().Location())
+		if expDate, err := time.ParseInLocation(legacyTrialFormat, enc, now().Location()); err == nil {
+			// Plain date, as stored by older versions
+			//
+			// We accept it only once, before the first trial record is
+			// written, and convert it to the record; installation ID could
+			// be generated before that (subscription key, usage report...)
+			trial = newTrialRecord(iid, expDate.AddDate(0, 0, -trialDays))
 			saveTrial = true
-		}
 
+			recorded, err := trialRecorded(ctx)
+			if err != nil {
+				logger.Error("could not load subscription trial", zap.Error(err))
+				return nil
+			}
+
+			if recorded {
+				tampered = errors.Wrap(errTrialTampered, "plain trial date found")
+			} else {
+				tampered = trial.Valid(iid)
+			}
+		} else {
+			trial, tampered = decodeTrialRecord(iid, enc)
+		}
+	} else if !isNewInstallation {
+		// Installation was here before the trial record
+		tampered = errors.Wrap(errTrialTampered, "trial removed")
 	} else {
 		logger.Info("creating generic trial key")
 
-		// Setting not found, create 30 day expiration
-		expDate = time.Date(now().Year(), now().Month(), now().Day()+31, 0, 0, 0, 0, now().Location())
+		var issued = now()
+		if first, err := firstActivity(ctx); err != nil {
+			logger.Warn("could not determine first activity, starting trial today", zap.Error(err))
+		} else if !first.IsZero() && first.Before(issued) {
+			issued = first
+		}
+
+		trial = newTrialRecord(iid, issued)
 		saveTrial = true
 	}
 
+	if tampered != nil {
+		logger.Warn("generic trial tampered with, falling back to expired trial", zap.Error(tampered))
+		trial = expiredTrialRecord(iid)
+		saveTrial = true
+	}
+
+	var claims = trial.claims()
+
 	if saveTrial {
-		v := &settings.Value{Name: settingSubscriptionTrialKey}
-		_ = v.SetValue(expDate.Format(expDateFormat))
-		if err := settingsSvc.Set(ctx, v); err != nil {
+		if err = saveTrialRecord(ctx, trial); err != nil {
 			logger.Error("could not save subscription trial", zap.Error(err))
 			return nil
 		}
+
+		if tampered != nil {
+			audit(ctx, AuditTrialTampered, claims, tampered.Error())
+		} else {
+			audit(ctx, AuditTrialCreated, claims, "generic trial created")
+		}
+	}
+
+	return claims
+}
+
+// Replaces generic trial with a new one that starts today
+//
+// Used by support to give installation another trial period on purpose
+// (reset-trial command); reset is recorded in the audit log
+func resetTrial(ctx context.Context) (*Claims, error) {
+	ctx = auth.SetSuperUserContext(ctx)
+
+	release, err := lockInstallation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	iid, _, err := createInstallationID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var trial = newTrialRecord(iid, now())
+	if err = saveTrialRecord(ctx, trial); err != nil {
+		return nil, err
+	}
+
+	claims := trial.claims()
+	audit(ctx, AuditTrialReset, claims, "generic trial reset")
+	return claims, nil
+}
+
+// Stores generic trial record
+func saveTrialRecord(ctx context.Context, trial *trialRecord) error {
+	enc, err := trial.encode()
+	if err != nil {
+		return errors.Wrap(err, "could not encode subscription trial")
+	}
+
+	v := &settings.Value{Name: settingSubscriptionTrialKey}
+	_ = v.SetValue(enc)
+	if err = settingsSvc.Set(ctx, v); err != nil {
+		return errors.Wrap(err, "could not save subscription trial")
+	}
+
+	if recorded, err := trialRecorded(ctx); err != nil || recorded {
+		return err
+	}
+
+	v = &settings.Value{Name: settingSubscriptionTrialRecordedKey}
+	_ = v.SetValue(trial.InstallationID)
+	return errors.Wrap(settingsSvc.Set(ctx, v), "could not save subscription trial")
+}
+
+// Checks if generic trial record was ever written
+func trialRecorded(ctx context.Context) (bool, error) {
+	v, err := settingsSvc.Get(ctx, settingSubscriptionTrialRecordedKey, 0)
+	if err != nil {
+		return false, errors.Wrap(err, "could not load subscription trial")
 	}
 
-	return &Claims{Trial: true, MaxUsers: 10, Expires: expDate}
+	return v.String() != "", nil
 }
@@ -0,0 +1,61 @@
+package subscription
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+)
+
+var (
+	errLockTimeout = errors.New("timed out waiting for database lock")
+
+	// Takes named database lock, replaced in tests
+	lockDB = getLock
+)
+
+// Takes named database lock, waits for it up to timeout
+//
+// Lock is held on a dedicated connection of the system database so that
+// it is shared by all replicas using the same database. errLockTimeout
+// is returned when lock could not be taken in time.
+func getLock(ctx context.Context, name string, timeout time.Duration) (release func(), err error) {
+	var (
+		db   *factory.DB
+		conn *sql.Conn
+		ok   sql.NullInt64
+	)
+
+	if db, err = factory.Database.Get("system"); err != nil {
+		return nil, err
+	}
+
+	if conn, err = db.DB.Conn(ctx); err != nil {
+		return nil, err
+	}
+
+	err = conn.
+		QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(timeout.Seconds())).
+		Scan(&ok)
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if !ok.Valid || ok.Int64 != 1 {
+		_ = conn.Close()
+		return nil, errLockTimeout
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", name); err != nil {
+			logger.Warn("could not release database lock", zap.String("lock", name), zap.Error(err))
+		}
+
+		_ = conn.Close()
+	}, nil
+}
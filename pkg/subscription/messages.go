@@ -0,0 +1,246 @@
+package subscription
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+)
+
+const (
+	defaultLanguage = "en"
+
+	// Subject of notifications (see notifier), kept in the catalogue with messages
+	notificationSubject = "notification-subject"
+
+	// Labels of quota resources are kept in the catalogue under
+	// quota-resource.<resource>, see render()
+	quotaResourcePrefix = "quota-resource."
+
+	// Sentence with renewal URL, replaces [renewal-notice] in messages
+	// when renewal URL is set (see Branding), see render()
+	renewalNotice = "renewal-notice"
+
+	// User's language setting (owned by the user)
+	settingUserLanguageKey = "language"
+)
+
+var (
+	// Message templates per language and error code
+	//
+	// Placeholders ([exp-date], [contact-email]...) are replaced with
+	// error's params, see subscription.error()
+	catalogue = map[string]map[string]string{
+		"en": {
+			notificationSubject: `[product-name] subscription notice`,
+
+			ErrCodeWillExpire:      `This [product-name] subscription will expire on [exp-date]. Please contact [contact-email] to renew the subscription.[renewal-notice]`,
+			ErrCodeExpired:         `This [product-name] subscription has expired. Please contact your administrator or [contact-email] to renew the subscription.[renewal-notice]`,
+			ErrCodeTrialWillExpire: `This [product-name] trial will expire on [exp-date]. To convert this trial in a to a subscription, please contact [contact-email].`,
+			ErrCodeTrialExpired:    `Your [product-name] trial has expired. Please contact [contact-email] to learn how to convert this trial in to a [product-name] subscription.`,
+			ErrCodeInvalidKey:      `Unverified or invalid subscription key. Please contact your administrator or [contact-email].`,
+
+			ErrCodeTrialUserLimit: `The [product-name] trial is limited to [user-limit] user(s). If you need more users, please contact us at [contact-email].`,
+			ErrCodeUserLimit:      `Your subscription user limit has been reached. Please contact [contact-email] to learn how to increase the number of users.`,
+			ErrCodeSignupDisabled: `Registration is disabled at the moment. Please contact your administrator.`,
+
+			ErrCodeNotEntitled: `Your subscription does not include [feature]. Please contact [contact-email] to learn how to extend your subscription.`,
+
+			ErrCodeTrialQuota: `The [product-name] trial is limited to [quota-limit] [quota-resource]. If you need more, please contact us at [contact-email].`,
+			ErrCodeQuota:      `Your subscription limit of [quota-limit] [quota-resource] has been reached. Please contact [contact-email] to learn how to increase the limit.`,
+
+			ErrCodeReadOnly: `This [product-name] subscription has expired and is in read-only mode. Please contact your administrator or [contact-email] to renew the subscription.[renewal-notice]`,
+
+			ErrCodeSessionLimit:   `All [session-limit] concurrent session(s) of this [product-name] subscription are in use. Please try again later or contact your administrator.`,
+			ErrCodeSessionEvicted: `Your session has ended because the concurrent session limit of this [product-name] subscription has been reached. Please log in again.`,
+
+			quotaResourcePrefix + QuotaNamespaces:   `namespace(s)`,
+			quotaResourcePrefix + QuotaModules:      `module(s)`,
+			quotaResourcePrefix + QuotaRecords:      `record(s)`,
+			quotaResourcePrefix + QuotaChannels:     `channel(s)`,
+			quotaResourcePrefix + QuotaStorageBytes: `bytes of storage`,
+
+			renewalNotice: ` You can also renew it at [renewal-url].`,
+		},
+
+		"de": {
+			notificationSubject: `Hinweis zum [product-name]-Abonnement`,
+
+			ErrCodeWillExpire:      `Dieses [product-name]-Abonnement läuft am [exp-date] ab. Bitte wenden Sie sich an [contact-email], um das Abonnement zu verlängern.[renewal-notice]`,
+			ErrCodeExpired:         `Dieses [product-name]-Abonnement ist abgelaufen. Bitte wenden Sie sich an Ihren Administrator oder an [contact-email], um das Abonnement zu verlängern.[renewal-notice]`,
+			ErrCodeTrialWillExpire: `Diese [product-name]-Testversion läuft am [exp-date] ab. Um die Testversion in ein Abonnement umzuwandeln, wenden Sie sich bitte an [contact-email].`,
+			ErrCodeTrialExpired:    `Ihre [product-name]-Testversion ist abgelaufen. Bitte wenden Sie sich an [contact-email], um zu erfahren, wie Sie die Testversion in ein [product-name]-Abonnement umwandeln können.`,
+			ErrCodeInvalidKey:      `Nicht verifizierter oder ungültiger Abonnementschlüssel. Bitte wenden Sie sich an Ihren Administrator oder an [contact-email].`,
+
+			ErrCodeTrialUserLimit: `Die [product-name]-Testversion ist auf [user-limit] Benutzer beschränkt. Wenn Sie mehr Benutzer benötigen, kontaktieren Sie uns bitte unter [contact-email].`,
+			ErrCodeUserLimit:      `Das Benutzerlimit Ihres Abonnements wurde erreicht. Bitte wenden Sie sich an [contact-email], um zu erfahren, wie Sie die Anzahl der Benutzer erhöhen können.`,
+			ErrCodeSignupDisabled: `Die Registrierung ist derzeit deaktiviert. Bitte wenden Sie sich an Ihren Administrator.`,
+
+			ErrCodeNotEntitled: `Ihr Abonnement umfasst [feature] nicht. Bitte wenden Sie sich an [contact-email], um zu erfahren, wie Sie Ihr Abonnement erweitern können.`,
+
+			ErrCodeTrialQuota: `Die [product-name]-Testversion ist auf [quota-limit] [quota-resource] beschränkt. Wenn Sie mehr benötigen, kontaktieren Sie uns bitte unter [contact-email].`,
+			ErrCodeQuota:      `Das Limit Ihres Abonnements von [quota-limit] [quota-resource] wurde erreicht. Bitte wenden Sie sich an [contact-email], um zu erfahren, wie Sie das Limit erhöhen können.`,
+
+			ErrCodeReadOnly: `Dieses [product-name]-Abonnement ist abgelaufen und befindet sich im Nur-Lese-Modus. Bitte wenden Sie sich an Ihren Administrator oder an [contact-email], um das Abonnement zu verlängern.[renewal-notice]`,
+
+			ErrCodeSessionLimit:   `Alle [session-limit] gleichzeitigen Sitzungen dieses [product-name]-Abonnements sind belegt. Bitte versuchen Sie es später erneut oder wenden Sie sich an Ihren Administrator.`,
+			ErrCodeSessionEvicted: `Ihre Sitzung wurde beendet, da das Limit gleichzeitiger Sitzungen dieses [product-name]-Abonnements erreicht wurde. Bitte melden Sie sich erneut an.`,
+
+			quotaResourcePrefix + QuotaNamespaces:   `Namespace(s)`,
+			quotaResourcePrefix + QuotaModules:      `Modul(e)`,
+			quotaResourcePrefix + QuotaRecords:      `Datensatz/Datensätze`,
+			quotaResourcePrefix + QuotaChannels:     `Kanal/Kanäle`,
+			quotaResourcePrefix + QuotaStorageBytes: `Bytes Speicherplatz`,
+
+			renewalNotice: ` Sie können es auch unter [renewal-url] verlängern.`,
+		},
+	}
+
+	// How expiration date is presented in messages
+	dateFormats = map[string]string{
+		"en": time.RFC1123,
+		"de": "02.01.2006",
+	}
+)
+
+// Renders message for the given language, error code and params
+//
+// Falls back to default language when there is no template for the given one;
+// quota resource is replaced with its label in the same language. Renewal
+// notice is added only when there is a renewal URL.
+func render(lang, code string, params map[string]string) string {
+	if _, ok := catalogue[lang][code]; !ok {
+		lang = defaultLanguage
+	}
+
+	var (
+		rr     = make([]string, 0, len(params)*2+2)
+		notice string
+	)
+
+	if url := params["renewal-url"]; url != "" {
+		notice = strings.Replace(catalogue[lang][renewalNotice], "[renewal-url]", url, 1)
+	}
+
+	rr = append(rr, "["+renewalNotice+"]", notice)
+
+	for k, v := range params {
+		if k == "exp-date" {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				v = t.Format(dateFormats[lang])
+			}
+		}
+
+		if k == "quota-resource" {
+			if l, ok := catalogue[lang][quotaResourcePrefix+v]; ok {
+				v = l
+			}
+		}
+
+		rr = append(rr, "["+k+"]", v)
+	}
+
+	return strings.NewReplacer(rr...).Replace(catalogue[lang][code])
+}
+
+// Returns language from the catalogue that best matches the request
+//
+// User's language setting takes precedence over Accept-Language header
+func requestLanguage(r *http.Request) string {
+	var tags = acceptLanguage(r.Header.Get("Accept-Language"))
+
+	if l := userLanguage(r.Context()); l != "" {
+		tags = append([]string{l}, tags...)
+	}
+
+	return matchLanguage(tags...)
+}
+
+// Returns first language tag that we have the messages for
+func matchLanguage(tags ...string) string {
+	for _, tag := range tags {
+		// en-US, en_US => en
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if i := strings.IndexAny(tag, "-_"); i > -1 {
+			tag = tag[:i]
+		}
+
+		if _, ok := catalogue[tag]; ok {
+			return tag
+		}
+	}
+
+	return defaultLanguage
+}
+
+// Parses Accept-Language header and returns language tags ordered by quality
+func acceptLanguage(header string) []string {
+	type (
+		weighted struct {
+			tag string
+			q   float64
+		}
+	)
+
+	var ww []weighted
+
+	for _, part := range strings.Split(header, ",") {
+		var (
+			w  = weighted{q: 1}
+			pp = strings.Split(part, ";")
+		)
+
+		if w.tag = strings.TrimSpace(pp[0]); w.tag == "" || w.tag == "*" {
+			continue
+		}
+
+		for _, p := range pp[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					w.q = q
+				}
+			}
+		}
+
+		if w.q > 0 {
+			ww = append(ww, w)
+		}
+	}
+
+	sort.SliceStable(ww, func(i, j int) bool { return ww[i].q > ww[j].q })
+
+	tags := make([]string, len(ww))
+	for i := range ww {
+		tags[i] = ww[i].tag
+	}
+
+	return tags
+}
+
+// Returns language setting of the current user
+func userLanguage(ctx context.Context) string {
+	var i = auth.GetIdentityFromContext(ctx)
+	if !i.Valid() {
+		return ""
+	}
+
+	return languageOf(ctx, i.Identity())
+}
+
+// Returns language setting of the given user
+func languageOf(ctx context.Context, userID uint64) string {
+	if settingsSvc == nil {
+		return ""
+	}
+
+	v, err := settingsSvc.Get(auth.SetSuperUserContext(ctx), settingUserLanguageKey, userID)
+	if err != nil {
+		return ""
+	}
+
+	return v.String()
+}
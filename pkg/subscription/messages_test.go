@@ -0,0 +1,125 @@
+package subscription
+
+import (
+	"testing"
+)
+
+func TestAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"de-DE,de;q=0.9,en;q=0.8", []string{"de-DE", "de", "en"}},
+		{"en;q=0.5, de;q=0.9", []string{"de", "en"}},
+		{"fr, de;q=0.7, en", []string{"fr", "en", "de"}},
+		{"*, de;q=0.5", []string{"de"}},
+		{"de;q=0, en", []string{"en"}},
+		{"de;q=x", []string{"de"}},
+		{" , ;q=1", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := acceptLanguage(tt.header); !equalStrings(got, tt.want) {
+			t.Errorf("acceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestMatchLanguage(t *testing.T) {
+	tests := []struct {
+		tags []string
+		want string
+	}{
+		{nil, defaultLanguage},
+		{[]string{"de"}, "de"},
+		{[]string{"DE-at"}, "de"},
+		{[]string{"de_CH"}, "de"},
+		{[]string{"fr", "de", "en"}, "de"},
+		{[]string{"fr", "it"}, defaultLanguage},
+		{[]string{"", " en-GB "}, "en"},
+	}
+
+	for _, tt := range tests {
+		if got := matchLanguage(tt.tags...); got != tt.want {
+			t.Errorf("matchLanguage(%v) = %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		lang   string
+		code   string
+		params map[string]string
+		want   string
+	}{
+		{
+			"en",
+			ErrCodeWillExpire,
+			map[string]string{"product-name": "Crust", "exp-date": "2019-06-01T00:00:00Z", "contact-email": "sales@example.com"},
+			"This Crust subscription will expire on Sat, 01 Jun 2019 00:00:00 UTC. Please contact sales@example.com to renew the subscription.",
+		},
+		{
+			"de",
+			ErrCodeWillExpire,
+			map[string]string{"product-name": "Crust", "exp-date": "2019-06-01T00:00:00Z", "contact-email": "sales@example.com"},
+			"Dieses Crust-Abonnement läuft am 01.06.2019 ab. Bitte wenden Sie sich an sales@example.com, um das Abonnement zu verlängern.",
+		},
+		{
+			"fr",
+			ErrCodeSignupDisabled,
+			nil,
+			"Registration is disabled at the moment. Please contact your administrator.",
+		},
+		{
+			"en",
+			ErrCodeQuota,
+			map[string]string{"quota-limit": "100", "quota-resource": QuotaRecords, "contact-email": "sales@example.com"},
+			"Your subscription limit of 100 record(s) has been reached. Please contact sales@example.com to learn how to increase the limit.",
+		},
+		{
+			"de",
+			ErrCodeTrialQuota,
+			map[string]string{"product-name": "Crust", "quota-limit": "5", "quota-resource": QuotaChannels, "contact-email": "sales@example.com"},
+			"Die Crust-Testversion ist auf 5 Kanal/Kanäle beschränkt. Wenn Sie mehr benötigen, kontaktieren Sie uns bitte unter sales@example.com.",
+		},
+		{
+			"en",
+			ErrCodeQuota,
+			map[string]string{"quota-limit": "1", "quota-resource": "unknown.resource", "contact-email": "sales@example.com"},
+			"Your subscription limit of 1 unknown.resource has been reached. Please contact sales@example.com to learn how to increase the limit.",
+		},
+		{
+			"en",
+			ErrCodeExpired,
+			map[string]string{"product-name": "Crust", "exp-date": "not a date"},
+			"This Crust subscription has expired. Please contact your administrator or [contact-email] to renew the subscription.",
+		},
+		{
+			"en",
+			ErrCodeExpired,
+			map[string]string{"product-name": "Crust", "contact-email": "sales@example.com", "renewal-url": "https://example.com/renew"},
+			"This Crust subscription has expired. Please contact your administrator or sales@example.com to renew the subscription. You can also renew it at https://example.com/renew.",
+		},
+		{
+			"de",
+			ErrCodeReadOnly,
+			map[string]string{"product-name": "Crust", "contact-email": "sales@example.com", "renewal-url": "https://example.com/renew"},
+			"Dieses Crust-Abonnement ist abgelaufen und befindet sich im Nur-Lese-Modus. Bitte wenden Sie sich an Ihren Administrator oder an sales@example.com, um das Abonnement zu verlängern. Sie können es auch unter https://example.com/renew verlängern.",
+		},
+		{
+			"en",
+			ErrCodeReadOnly,
+			map[string]string{"product-name": "Crust", "contact-email": "sales@example.com", "renewal-url": ""},
+			"This Crust subscription has expired and is in read-only mode. Please contact your administrator or sales@example.com to renew the subscription.",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := render(tt.lang, tt.code, tt.params); got != tt.want {
+			t.Errorf("render(%q, %q)\n got: %s\nwant: %s", tt.lang, tt.code, got, tt.want)
+		}
+	}
+}
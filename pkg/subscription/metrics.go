@@ -0,0 +1,170 @@
+package subscription
+
+import (
+	"context"
+
+	"github.com/99designs/basicauth-go"
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+const (
+	metricsNamespace = "crust_subscription"
+)
+
+var (
+	// Registry with subscription metrics only, served by MountMetrics
+	//
+	// Metrics are registered with the default registry as well so they
+	// are included in the server's /metrics (when enabled)
+	metricsRegistry = prometheus.NewRegistry()
+
+	domainMismatchCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "domain_mismatch_total",
+		Help:      "Number of subscription checks for domains not covered by the subscription",
+	})
+
+	userCreationBlockedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "user_creation_blocked_total",
+		Help:      "Number of blocked user creations and registrations",
+	}, []string{"reason"})
+
+	seatsUsedDesc = prometheus.NewDesc(
+		metricsNamespace+"_seats_used",
+		"Number of seats used under subscription's seat policy",
+		nil,
+		nil,
+	)
+)
+
+type (
+	// Collects number of used seats
+	//
+	// Sample is skipped when seats can not be counted
+	// so that outage is not reported as free seats
+	seatsCollector struct{}
+)
+
+func init() {
+	var cc = []prometheus.Collector{
+		domainMismatchCounter,
+		userCreationBlockedCounter,
+
+		subscriptionGauge("valid", "Is subscription valid (1) or not (0)", func(s *subscription) float64 {
+			return boolMetric(s.isValid)
+		}),
+
+		subscriptionGauge("trial", "Is subscription a trial (1) or not (0)", func(s *subscription) float64 {
+			return boolMetric(s.isTrial)
+		}),
+
+		subscriptionGauge("read_only", "Is subscription in read-only mode (1) or not (0)", func(s *subscription) float64 {
+			return boolMetric(s.isReadOnly())
+		}),
+
+		subscriptionGauge("days_left", "Number of days until subscription expires", func(s *subscription) float64 {
+			return float64(Claims{Expires: s.expires}.DaysLeft())
+		}),
+
+		subscriptionGauge("seats_limit", "Max number of seats, 0 when unlimited", func(s *subscription) float64 {
+			return float64(s.limitMaxUsers)
+		}),
+
+		subscriptionGauge("sessions_limit", "Max number of concurrent sessions, 0 when unlimited", func(s *subscription) float64 {
+			return float64(s.limitMaxSessions)
+		}),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_active",
+			Help:      "Number of concurrent sessions",
+		}, func() float64 {
+			return float64(sessions.count(context.Background(), 0))
+		}),
+
+		seatsCollector{},
+	}
+
+	for _, c := range cc {
+		metricsRegistry.MustRegister(c)
+		prometheus.MustRegister(c)
+	}
+}
+
+// Creates gauge that reads its value from the current subscription
+func subscriptionGauge(name, help string, fn func(s *subscription) float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+	}, func() float64 {
+		s, ok := service.CurrentSubscription.(*subscription)
+		if !ok {
+			return 0
+		}
+
+		s.RLock()
+		defer s.RUnlock()
+		return fn(s)
+	})
+}
+
+func (seatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- seatsUsedDesc
+}
+
+func (seatsCollector) Collect(ch chan<- prometheus.Metric) {
+	s, ok := service.CurrentSubscription.(*subscription)
+	if !ok {
+		return
+	}
+
+	used, err := s.seatsUsed(context.Background())
+	if err != nil {
+		logger.Warn("could not count subscription seats", zap.Error(err))
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(seatsUsedDesc, prometheus.GaugeValue, float64(used))
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// MountMetrics mounts subscription metrics endpoint (/subscription/metrics)
+//
+// Endpoint is protected with basic auth and is not mounted
+// when metrics are disabled or password is not set.
+//
+// Expected to be registered through cli.Config's ApiServerRoutes
+func MountMetrics(r chi.Router) {
+	if !opt.MetricsEnabled {
+		return
+	}
+
+	if opt.MetricsPassword == "" {
+		logger.Warn("subscription metrics endpoint not mounted, password is not set")
+		return
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(basicauth.New("Subscription metrics", map[string][]string{
+			opt.MetricsUsername: {opt.MetricsPassword},
+		}))
+
+		r.Handle("/subscription/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	})
+
+	logger.Debug("subscription metrics endpoint mounted", zap.String("path", "/subscription/metrics"))
+}
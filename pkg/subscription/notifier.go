@@ -0,0 +1,353 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/mail"
+	"github.com/cortezaproject/corteza-server/pkg/permissions"
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+	"github.com/cortezaproject/corteza-server/pkg/sentry"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// Keeps track of sent notifications: notification key => when it was sent
+	notificationLog map[string]time.Time
+
+	admin struct {
+		ID    uint64 `db:"id"`
+		Email string `db:"email"`
+		Name  string `db:"name"`
+	}
+)
+
+const (
+	settingNotificationsKey = "crust-subscription.notifications"
+
+	// Sent notifications are forgotten after this period
+	notificationLogRetention = 400 * 24 * time.Hour
+
+	seatLimitNotificationPrefix = "seat-limit:"
+
+	// Name of the database lock that serializes sending of notifications
+	// (and changes of sent notifications log) across replicas
+	notificationLockName = "crust-subscription.notifications"
+)
+
+// Notify periodically checks subscription and emails administrators
+// when subscription is about to expire (see NotifyDays option),
+// when it expires and when seat limit is reached
+//
+// Each notification is sent once to each administrator; sent notifications
+// are stored in settings.
+func Notify(ctx context.Context) {
+	if opt.NotifyInterval <= 0 {
+		logger.Debug("notifier disabled")
+		return
+	}
+
+	Subscribe(func(Event) {
+		if err := notifySeatLimit(ctx); err != nil {
+			logger.Warn("could not send subscription seat limit notification", zap.Error(err))
+		}
+	}, EventSeatsExhausted)
+
+	go func() {
+		defer sentry.Recover()
+
+		var ticker = time.NewTicker(opt.NotifyInterval)
+		defer ticker.Stop()
+
+		notify(ctx)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				notify(ctx)
+			}
+		}
+	}()
+}
+
+func notify(ctx context.Context) {
+	if err := notifyExpiry(ctx); err != nil {
+		logger.Warn("could not send subscription expiration notification", zap.Error(err))
+	}
+
+	if err := notifySeatLimit(ctx); err != nil {
+		logger.Warn("could not send subscription seat limit notification", zap.Error(err))
+	}
+}
+
+// Notifies administrators when subscription crosses one of the expiration thresholds
+//
+// Only the closest threshold is notified; when server was not running
+// at the time when others were crossed, they are skipped.
+func notifyExpiry(ctx context.Context) error {
+	s, ok := service.CurrentSubscription.(*subscription)
+	if !ok {
+		return nil
+	}
+
+	s.RLock()
+	var (
+		valid    = s.isValid
+		expires  = s.expires
+		daysLeft = Claims{Expires: s.expires}.DaysLeft()
+		e        *Error
+	)
+
+	switch {
+	case s.isTrial && daysLeft <= 0:
+		e = s.error(trialHasExpired)
+	case s.isTrial:
+		e = s.error(trialWillExpire)
+	case daysLeft <= 0:
+		e = s.error(hasExpired)
+	default:
+		e = s.error(willExpire)
+	}
+	s.RUnlock()
+
+	if !valid {
+		return nil
+	}
+
+	threshold, crossed := expiryThreshold(daysLeft, opt.NotifyDays)
+	if !crossed {
+		return nil
+	}
+
+	return notifyOnce(ctx, fmt.Sprintf("expiry:%s:%d", expires.Format("2006-01-02"), threshold), e)
+}
+
+// Returns the smallest threshold (in days) that was crossed
+//
+// Expiration itself (0 days) is always a threshold
+func expiryThreshold(daysLeft int, thresholds []int) (int, bool) {
+	var tt = append([]int{0}, thresholds...)
+	sort.Ints(tt)
+
+	for _, t := range tt {
+		if daysLeft <= t {
+			return t, true
+		}
+	}
+
+	return 0, false
+}
+
+// Notifies administrators when all seats are taken
+//
+// When seats are freed, notification can be sent again
+func notifySeatLimit(ctx context.Context) error {
+	s, ok := service.CurrentSubscription.(*subscription)
+	if !ok {
+		return nil
+	}
+
+	m, err := seatMetrics(ctx, organisationSeats(0))
+	if err != nil {
+		return err
+	}
+
+	s.RLock()
+	var (
+		used  = m.Used(s.seatPolicy)
+		limit = s.limitMaxUsers
+		e     = s.error(addUserError)
+	)
+
+	if s.isTrial {
+		e = s.error(trialAddUserError)
+	}
+	s.RUnlock()
+
+	if limit == 0 || used < limit {
+		return forgetNotifications(ctx, seatLimitNotificationPrefix)
+	}
+
+	return notifyOnce(ctx, fmt.Sprintf("%s%d", seatLimitNotificationPrefix, limit), e)
+}
+
+// Sends notification to administrators that did not receive it yet
+//
+// Each sent email is recorded right away; when sending fails, the rest of
+// administrators are still notified and the failed ones are retried later.
+func notifyOnce(ctx context.Context, key string, e *Error) error {
+	ctx = auth.SetSuperUserContext(ctx)
+
+	release, err := lockNotifications(ctx)
+	if err != nil || release == nil {
+		return err
+	}
+
+	defer release()
+
+	nl, err := loadNotificationLog(ctx)
+	if err != nil {
+		return err
+	}
+
+	aa, err := admins(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(aa) == 0 {
+		return errors.New("no administrators with email address")
+	}
+
+	var failed error
+	for _, a := range aa {
+		var rk = notificationKey(key, a.ID)
+		if _, sent := nl[rk]; sent {
+			continue
+		}
+
+		if err = notifyAdmin(ctx, a, e); err != nil {
+			logger.Warn("could not send subscription notification", zap.String("notification", key), zap.Uint64("userID", a.ID), zap.Error(err))
+			failed = err
+			continue
+		}
+
+		logger.Info("subscription notification sent", zap.String("notification", key), zap.String("code", e.Code), zap.Uint64("userID", a.ID))
+
+		nl[rk] = now()
+		if err = saveNotificationLog(ctx, nl); err != nil {
+			return err
+		}
+	}
+
+	return failed
+}
+
+// Returns key of the notification sent to the user
+func notificationKey(key string, userID uint64) string {
+	return key + "@" + strconv.FormatUint(userID, 10)
+}
+
+// Removes sent notifications with the given key prefix
+func forgetNotifications(ctx context.Context, prefix string) error {
+	ctx = auth.SetSuperUserContext(ctx)
+
+	release, err := lockNotifications(ctx)
+	if err != nil || release == nil {
+		return err
+	}
+
+	defer release()
+
+	nl, err := loadNotificationLog(ctx)
+	if err != nil {
+		return err
+	}
+
+	var changed bool
+	for key := range nl {
+		if strings.HasPrefix(key, prefix) {
+			delete(nl, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return saveNotificationLog(ctx, nl)
+}
+
+// Takes notifications lock; nil release (w/o error) is returned
+// when another replica holds it for too long, that one sends notifications
+func lockNotifications(ctx context.Context) (release func(), err error) {
+	release, err = lockDB(ctx, notificationLockName, opt.LockTimeout)
+	if err == errLockTimeout {
+		return nil, nil
+	}
+
+	return
+}
+
+func loadNotificationLog(ctx context.Context) (notificationLog, error) {
+	var nl = notificationLog{}
+
+	if settingsSvc == nil {
+		return nil, errors.New("no settings service")
+	}
+
+	v, err := settingsSvc.Get(ctx, settingNotificationsKey, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load sent notifications")
+	}
+
+	if v != nil {
+		if err = json.Unmarshal(v.Value, &nl); err != nil {
+			logger.Warn("could not decode sent notifications", zap.Error(err))
+			nl = notificationLog{}
+		}
+	}
+
+	return nl, nil
+}
+
+func saveNotificationLog(ctx context.Context, nl notificationLog) error {
+	for key, sent := range nl {
+		if now().Sub(sent) > notificationLogRetention {
+			delete(nl, key)
+		}
+	}
+
+	v := &settings.Value{Name: settingNotificationsKey}
+	_ = v.SetValue(nl)
+
+	return errors.Wrap(settingsSvc.Set(ctx, v), "could not save sent notifications")
+}
+
+// Emails error to administrator, in their language
+func notifyAdmin(ctx context.Context, a *admin, e *Error) error {
+	var (
+		lang = matchLanguage(languageOf(ctx, a.ID))
+		m    = mail.New()
+	)
+
+	m.SetAddressHeader("To", a.Email, a.Name)
+	m.SetHeader("Subject", render(lang, notificationSubject, e.Params))
+	m.SetBody("text/plain", e.Localize(lang).Message)
+
+	return mail.Send(m)
+}
+
+// Returns active members of administrators role
+func admins(ctx context.Context) ([]*admin, error) {
+	var (
+		aa = make([]*admin, 0)
+		q  = squirrel.
+			Select("id", "email", "name").
+			From("sys_user").
+			Where(squirrel.Expr("id IN (SELECT rel_user FROM sys_role_member WHERE rel_role = ?)", permissions.AdminsRoleID)).
+			Where("deleted_at IS NULL AND suspended_at IS NULL AND email <> ''")
+	)
+
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return nil, err
+	}
+
+	return aa, rh.FetchAll(db.With(ctx), q, &aa)
+}
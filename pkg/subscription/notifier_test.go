@@ -0,0 +1,42 @@
+package subscription
+
+import (
+	"testing"
+)
+
+func TestExpiryThreshold(t *testing.T) {
+	tests := []struct {
+		daysLeft   int
+		thresholds []int
+		want       int
+		crossed    bool
+	}{
+		{60, []int{30, 7, 1}, 0, false},
+		{31, []int{30, 7, 1}, 0, false},
+		{30, []int{30, 7, 1}, 30, true},
+		{8, []int{30, 7, 1}, 30, true},
+		{7, []int{30, 7, 1}, 7, true},
+		{1, []int{1, 7, 30}, 1, true},
+		{0, []int{30, 7, 1}, 0, true},
+		{-3, []int{30, 7, 1}, 0, true},
+		{5, nil, 0, false},
+		{0, nil, 0, true},
+		{7, []int{7, 7}, 7, true},
+	}
+
+	for _, tt := range tests {
+		got, crossed := expiryThreshold(tt.daysLeft, tt.thresholds)
+		if got != tt.want || crossed != tt.crossed {
+			t.Errorf("expiryThreshold(%d, %v) = %d, %v, want %d, %v", tt.daysLeft, tt.thresholds, got, crossed, tt.want, tt.crossed)
+		}
+	}
+}
+
+func TestExpiryThresholdKeepsThresholds(t *testing.T) {
+	var thresholds = []int{30, 7, 1}
+	expiryThreshold(5, thresholds)
+
+	if !(thresholds[0] == 30 && thresholds[1] == 7 && thresholds[2] == 1) {
+		t.Errorf("expiryThreshold() reordered thresholds: %v", thresholds)
+	}
+}
@@ -0,0 +1,141 @@
+package subscription
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cortezaproject/corteza-server/pkg/cli/options"
+)
+
+type (
+	Opt struct {
+		// How often do we check for subscription key changes
+		WatchInterval time.Duration
+
+		// Directory with additional trusted public keys (<kid>.pem)
+		KeysDir string
+
+		// Subscription key sources that take precedence over settings
+		KeyFile string
+		Key     string
+
+		// Expected issuer (iss claim) of subscription keys, not checked when empty
+		Issuer string
+
+		// Accepted audiences (aud claim), product and edition when empty
+		Audience []string
+
+		// Tolerated clock difference when validating nbf and iat claims
+		ClockSkew time.Duration
+
+		// Proxies (IPs or CIDRs) that we accept X-Forwarded-Host header from
+		TrustedProxies []string
+
+		// How long do we wait for database locks held by other replicas
+		// (seat reservations, session registrations, installation setup, notifications)
+		LockTimeout time.Duration
+
+		// Number of days after expiration before server switches to read-only mode,
+		// for subscription keys (and trials) w/o grace days claim
+		GraceDays uint
+
+		// Sessions w/o requests for this long are not counted as concurrent
+		SessionIdleTimeout time.Duration
+
+		// Evict the oldest session when concurrent session limit is reached
+		// instead of rejecting the new one
+		SessionEvict bool
+
+		// Organisations can have their own subscription keys (multi-tenant hosting)
+		//
+		// Users created outside of the API (CLI) take seats of the current subscription;
+		// metrics, events and notifications cover the current subscription only
+		Tenants bool
+
+		// How often do we sample usage (for peak values), 0 disables usage reporting
+		UsageSampleInterval time.Duration
+
+		// How often do we write signed usage reports and where;
+		// reports are not written when directory is not set
+		//
+		// Report is written by one of the replicas, when it samples
+		// usage after the interval passed
+		UsageReportInterval time.Duration
+		UsageReportDir      string
+
+		// How often do we check if administrators need to be notified, 0 disables notifications
+		NotifyInterval time.Duration
+
+		// Notify administrators when there are this many days left until expiration
+		NotifyDays []int
+
+		// Subscription metrics endpoint (/subscription/metrics) and its basic auth credentials
+		MetricsEnabled  bool
+		MetricsUsername string
+		MetricsPassword string
+	}
+)
+
+// Options reads subscription options from the environment
+func Options() *Opt {
+	return &Opt{
+		WatchInterval: options.EnvDuration("", "SUBSCRIPTION_WATCH_INTERVAL", time.Minute),
+		KeysDir:       options.EnvString("", "SUBSCRIPTION_KEYS_DIR", ""),
+		KeyFile:       options.EnvString("", "SUBSCRIPTION_KEY_FILE", ""),
+		Key:           options.EnvString("", "SUBSCRIPTION_KEY", ""),
+
+		Issuer:    options.EnvString("", "SUBSCRIPTION_ISSUER", "crust.tech"),
+		Audience:  envList("SUBSCRIPTION_AUDIENCE"),
+		ClockSkew: options.EnvDuration("", "SUBSCRIPTION_CLOCK_SKEW", 5*time.Minute),
+
+		TrustedProxies: envList("SUBSCRIPTION_TRUSTED_PROXIES"),
+
+		LockTimeout: options.EnvDuration("", "SUBSCRIPTION_LOCK_TIMEOUT", 10*time.Second),
+
+		GraceDays: uint(options.EnvInt("", "SUBSCRIPTION_GRACE_DAYS", 7)),
+
+		SessionIdleTimeout: options.EnvDuration("", "SUBSCRIPTION_SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		SessionEvict:       options.EnvBool("", "SUBSCRIPTION_SESSION_EVICT", false),
+
+		Tenants: options.EnvBool("", "SUBSCRIPTION_TENANTS", false),
+
+		UsageSampleInterval: options.EnvDuration("", "SUBSCRIPTION_USAGE_SAMPLE_INTERVAL", time.Hour),
+		UsageReportInterval: options.EnvDuration("", "SUBSCRIPTION_USAGE_REPORT_INTERVAL", 30*24*time.Hour),
+		UsageReportDir:      options.EnvString("", "SUBSCRIPTION_USAGE_REPORT_DIR", ""),
+
+		NotifyInterval: options.EnvDuration("", "SUBSCRIPTION_NOTIFY_INTERVAL", time.Hour),
+		NotifyDays:     envIntList("SUBSCRIPTION_NOTIFY_DAYS", 30, 14, 7, 1),
+
+		MetricsEnabled:  options.EnvBool("", "SUBSCRIPTION_METRICS", false),
+		MetricsUsername: options.EnvString("", "SUBSCRIPTION_METRICS_USERNAME", "metrics"),
+		MetricsPassword: options.EnvString("", "SUBSCRIPTION_METRICS_PASSWORD", ""),
+	}
+}
+
+// Reads space or comma delimited list from the environment
+func envList(key string) []string {
+	return strings.FieldsFunc(options.EnvString("", key, ""), func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// Reads list of integers from the environment, invalid values are skipped
+func envIntList(key string, def ...int) []int {
+	var (
+		ss = envList(key)
+		ii = make([]int, 0, len(ss))
+	)
+
+	if len(ss) == 0 {
+		return def
+	}
+
+	for _, s := range ss {
+		if i, err := strconv.Atoi(s); err == nil {
+			ii = append(ii, i)
+		}
+	}
+
+	return ii
+}
@@ -0,0 +1,379 @@
+package subscription
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+)
+
+type (
+	// Resource quota that route consumes
+	consumedQuota string
+
+	// Counts current usage of a resource, only resources of the given owners when set
+	usageCounter func(ctx context.Context, o *usageOwners) (uint64, error)
+
+	// Returns filter for resources of the owners
+	ownerFilter func(o *usageOwners) squirrel.Sqlizer
+
+	// Namespaces and users whose resources are counted
+	//
+	// Compose resources belong to organisation through their namespace,
+	// messaging resources through the user that created them
+	usageOwners struct {
+		namespaces []uint64
+		users      []uint64
+
+		// Resources of all other namespaces and users are counted
+		exclude bool
+	}
+
+	// Attachments table and owner of its attachments
+	attachmentTable struct {
+		dbName string
+		table  string
+		owner  ownerFilter
+	}
+)
+
+const (
+	namespacesTable = "crust_subscription_namespaces"
+)
+
+var (
+	ErrQuotaCountFailed = errors.New("could not count resource usage")
+
+	// ComposeQuotas lists compose routes that consume resource quotas
+	//
+	// Records are checked by the guarded record service (see GuardServices)
+	ComposeQuotas = Routes{
+		on(http.MethodPost, "/namespace/", consumedQuota(QuotaNamespaces)),
+		on(http.MethodPost, "/namespace/*/module/", consumedQuota(QuotaModules)),
+		on(http.MethodPost, "/namespace/*/module/*/record/attachment", consumedQuota(QuotaStorageBytes)),
+		on(http.MethodPost, "/namespace/*/page/*/attachment", consumedQuota(QuotaStorageBytes)),
+	}
+
+	// MessagingQuotas lists messaging routes that consume resource quotas
+	//
+	// Channels are checked by the guarded channel service (see GuardServices)
+	MessagingQuotas = Routes{
+		on(http.MethodPost, "/channels/*/attach", consumedQuota(QuotaStorageBytes)),
+	}
+
+	// MonolithQuotas lists routes as they are mounted by monolith.Configure
+	MonolithQuotas = join(
+		ComposeQuotas.Prefixed("/compose"),
+		MessagingQuotas.Prefixed("/messaging"),
+	)
+
+	usageCounters = map[string]usageCounter{
+		QuotaNamespaces: countRows("compose", "compose_namespace", byNamespace("id")),
+		QuotaModules:    countRows("compose", "compose_module", byNamespace("rel_namespace")),
+		QuotaRecords:    countRows("compose", "compose_record", byNamespace("rel_namespace")),
+		QuotaChannels:   countRows("messaging", "messaging_channel", byUser("rel_creator")),
+		QuotaStorageBytes: sumAttachmentSize(
+			attachmentTable{"compose", "compose_attachment", byNamespace("rel_namespace")},
+			attachmentTable{"messaging", "messaging_attachment", byUser("rel_user")},
+		),
+	}
+
+	// Organisations of namespaces, recorded when namespace is created
+	// by the guarded namespace service (see GuardServices)
+	//
+	// Table is created on start (see createTables)
+	namespacesTableDDL = `CREATE TABLE IF NOT EXISTS ` + namespacesTable + ` (
+  rel_namespace    BIGINT UNSIGNED NOT NULL,
+  rel_organisation BIGINT UNSIGNED NOT NULL,
+  PRIMARY KEY (rel_namespace),
+  KEY idx_organisation (rel_organisation)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+)
+
+// QuotaMiddleware rejects requests that would exceed resource quotas of the current subscription
+func QuotaMiddleware(rr Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range rr.match(r) {
+				resource, ok := p.(consumedQuota)
+				if !ok {
+					continue
+				}
+
+				var adding uint64 = 1
+				if resource == QuotaStorageBytes {
+					size, cleanup, err := uploadSize(r)
+					defer cleanup()
+
+					if err != nil {
+						logger.Error("could not read upload", zap.Error(err))
+						writeError(w, r, err)
+						return
+					}
+
+					adding = size
+				}
+
+				if err := CheckQuota(r.Context(), string(resource), adding); err != nil {
+					writeError(w, r, err)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CheckQuota checks if subscription of the context (request's organisation
+// or the current one) allows adding to resource usage
+//
+// Usage is counted only when subscription has a quota for the resource.
+// When usage can not be counted, check fails.
+//
+// With organisation subscriptions enabled, usage of the organisation's
+// resources is counted (see organisationUsage).
+func CheckQuota(ctx context.Context, resource string, adding uint64) error {
+	s := subscriptionFor(ctx)
+	if s == nil || s.quota(resource) == 0 {
+		return nil
+	}
+
+	current, err := organisationUsage(ctx, resource, organisationOf(ctx))
+	if err != nil {
+		logger.Error("could not count resource usage", zap.String("resource", resource), zap.Error(err))
+		return ErrQuotaCountFailed
+	}
+
+	return s.CanUse(resource, current, adding)
+}
+
+// Returns size of the upload in request's body
+//
+// Server does not read more than Content-Length of the body, so declared
+// length is the size of the upload. Body of unknown length (chunked upload)
+// is spooled to a temporary file, at most one byte over the storage quota,
+// and replaced with it; returned function removes the file.
+func uploadSize(r *http.Request) (uint64, func(), error) {
+	var cleanup = func() {}
+
+	if r.ContentLength >= 0 {
+		return uint64(r.ContentLength), cleanup, nil
+	}
+
+	s := subscriptionFor(r.Context())
+	if s == nil || s.quota(QuotaStorageBytes) == 0 {
+		// Not limited, size does not matter
+		return 0, cleanup, nil
+	}
+
+	f, err := ioutil.TempFile("", "crust-upload-")
+	if err != nil {
+		return 0, cleanup, err
+	}
+
+	cleanup = func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+
+	var limit int64 = math.MaxInt64
+	if q := s.quota(QuotaStorageBytes); q < math.MaxInt64 {
+		limit = int64(q) + 1
+	}
+
+	// Upload over the quota is rejected, rest of it is not needed
+	size, err := io.Copy(f, io.LimitReader(r.Body, limit))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		return 0, cleanup, err
+	}
+
+	r.Body = ioutil.NopCloser(f)
+	r.ContentLength = size
+
+	return uint64(size), cleanup, nil
+}
+
+// Usage returns current usage of a resource by the whole installation
+func Usage(ctx context.Context, resource string) (uint64, error) {
+	if counter, ok := usageCounters[resource]; ok {
+		return counter(ctx, nil)
+	}
+
+	return 0, nil
+}
+
+// Returns current usage of a resource by the organisation (0 for the current subscription)
+//
+// Usage of the whole installation is returned when organisation subscriptions are disabled
+func organisationUsage(ctx context.Context, resource string, organisationID uint64) (uint64, error) {
+	counter, ok := usageCounters[resource]
+	if !ok {
+		return 0, nil
+	}
+
+	if !opt.Tenants {
+		return counter(ctx, nil)
+	}
+
+	o, err := organisationOwners(ctx, organisationID)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter(ctx, o)
+}
+
+// Returns namespaces and users of the organisation
+//
+// Resources of organisations w/o their own subscription key count against
+// the current subscription (0), same as their seats (see organisationSeats)
+//
+// Replaced in tests
+var organisationOwners = func(ctx context.Context, organisationID uint64) (*usageOwners, error) {
+	var (
+		o   = &usageOwners{}
+		ids = []uint64{organisationID}
+	)
+
+	if organisationID == 0 {
+		o.exclude = true
+		ids = []uint64{}
+		for id := range tenants.all() {
+			ids = append(ids, id)
+		}
+	}
+
+	db, err := systemDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		nq = squirrel.
+			Select("rel_namespace").
+			From(namespacesTable).
+			Where(squirrel.Eq{"rel_organisation": ids})
+
+		uq = squirrel.
+			Select("id").
+			From("sys_user").
+			Where(squirrel.Eq{"rel_organisation": ids})
+	)
+
+	if err = rh.FetchAll(db, nq, &o.namespaces); err != nil {
+		return nil, err
+	}
+
+	if err = rh.FetchAll(db, uq, &o.users); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Records organisation of a new namespace
+func assignNamespace(ctx context.Context, namespaceID, organisationID uint64) error {
+	if organisationID == 0 {
+		return nil
+	}
+
+	db, err := systemDB(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT IGNORE INTO "+namespacesTable+" (rel_namespace, rel_organisation) VALUES (?, ?)",
+		namespaceID,
+		organisationID,
+	)
+
+	return err
+}
+
+// Filters resources by their namespace
+func byNamespace(column string) ownerFilter {
+	return func(o *usageOwners) squirrel.Sqlizer {
+		return o.filter(column, o.namespaces)
+	}
+}
+
+// Filters resources by the user that created them
+func byUser(column string) ownerFilter {
+	return func(o *usageOwners) squirrel.Sqlizer {
+		return o.filter(column, o.users)
+	}
+}
+
+func (o *usageOwners) filter(column string, ids []uint64) squirrel.Sqlizer {
+	if o.exclude {
+		return squirrel.NotEq{column: ids}
+	}
+
+	return squirrel.Eq{column: ids}
+}
+
+// Counts non-deleted rows in a table
+func countRows(dbName, table string, owner ownerFilter) usageCounter {
+	return func(ctx context.Context, o *usageOwners) (uint64, error) {
+		db, err := factory.Database.Get(dbName)
+		if err != nil {
+			return 0, err
+		}
+
+		var q = squirrel.Select().From(table).Where("deleted_at IS NULL")
+		if o != nil {
+			q = q.Where(owner(o))
+		}
+
+		count, err := rh.Count(db.With(ctx), q)
+		return uint64(count), err
+	}
+}
+
+// Sums sizes of non-deleted attachments in all available databases
+func sumAttachmentSize(tables ...attachmentTable) usageCounter {
+	return func(ctx context.Context, o *usageOwners) (total uint64, err error) {
+		for _, t := range tables {
+			db, err := factory.Database.Get(t.dbName)
+			if err != nil {
+				// Service (and its database) is not part of this deployment
+				continue
+			}
+
+			var (
+				size uint64
+				q    = squirrel.
+					Select("COALESCE(SUM(JSON_EXTRACT(meta, '$.original.size')), 0)").
+					From(t.table).
+					Where("deleted_at IS NULL")
+			)
+
+			if o != nil {
+				q = q.Where(t.owner(o))
+			}
+
+			if err = rh.FetchOne(db.With(ctx), q, &size); err != nil {
+				return 0, err
+			}
+
+			total += size
+		}
+
+		return total, nil
+	}
+}
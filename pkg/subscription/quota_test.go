@@ -0,0 +1,243 @@
+package subscription
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+// Replaces usage counters with ones that return given usage, returns
+// function that restores them; owners the usage was counted for are recorded
+func useUsage(usage map[string]uint64, err error) (*[]*usageOwners, func()) {
+	var (
+		prev    = usageCounters
+		counted = &[]*usageOwners{}
+	)
+
+	usageCounters = map[string]usageCounter{}
+	for r, u := range usage {
+		u := u
+		usageCounters[r] = func(_ context.Context, o *usageOwners) (uint64, error) {
+			*counted = append(*counted, o)
+			return u, err
+		}
+	}
+
+	return counted, func() { usageCounters = prev }
+}
+
+func TestOwnerFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		owners usageOwners
+		filter ownerFilter
+		sql    string
+		args   int
+	}{
+		{"namespaces", usageOwners{namespaces: []uint64{1, 2}}, byNamespace("rel_namespace"), "rel_namespace IN (?,?)", 2},
+		{"no namespaces", usageOwners{}, byNamespace("id"), "(1=0)", 0},
+		{"other namespaces", usageOwners{namespaces: []uint64{1}, exclude: true}, byNamespace("id"), "id NOT IN (?)", 1},
+		{"all namespaces", usageOwners{exclude: true}, byNamespace("id"), "(1=1)", 0},
+		{"users", usageOwners{namespaces: []uint64{1}, users: []uint64{3}}, byUser("rel_creator"), "rel_creator IN (?)", 1},
+		{"other users", usageOwners{users: []uint64{3, 4}, exclude: true}, byUser("rel_user"), "rel_user NOT IN (?,?)", 2},
+	}
+
+	for _, tt := range tests {
+		sql, args, err := tt.filter(&tt.owners).ToSql()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if sql != tt.sql || len(args) != tt.args {
+			t.Errorf("%s: filter = %q with %d args, want %q with %d args", tt.name, sql, len(args), tt.sql, tt.args)
+		}
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+	opt.Tenants = true
+
+	_, restore := useSubscription(&Claims{Quotas: map[string]uint64{QuotaRecords: 100}, Expires: at.AddDate(1, 0, 0)})
+	defer restore()
+
+	var tenant = &subscription{}
+	tenant.Update(&Claims{Quotas: map[string]uint64{QuotaRecords: 10}, Expires: at.AddDate(1, 0, 0)})
+	defer useTenants(map[uint64]*subscription{7: tenant})()
+
+	var prevOwners = organisationOwners
+	defer func() { organisationOwners = prevOwners }()
+
+	organisationOwners = func(_ context.Context, organisationID uint64) (*usageOwners, error) {
+		return &usageOwners{namespaces: []uint64{organisationID}, exclude: organisationID == 0}, nil
+	}
+
+	var tenantCtx = context.WithValue(context.Background(), tenantCtxKey{}, tenant)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		used    uint64
+		allowed bool
+
+		// Namespace the usage is expected to be counted for
+		namespace uint64
+		exclude   bool
+	}{
+		{"installation, under quota", context.Background(), 50, true, 0, true},
+		{"installation, quota reached", context.Background(), 100, false, 0, true},
+		{"organisation, under quota", tenantCtx, 9, true, 7, false},
+		{"organisation, quota reached", tenantCtx, 10, false, 7, false},
+	}
+
+	for _, tt := range tests {
+		counted, restoreUsage := useUsage(map[string]uint64{QuotaRecords: tt.used}, nil)
+
+		if err := CheckQuota(tt.ctx, QuotaRecords, 1); (err == nil) != tt.allowed {
+			t.Errorf("%s: CheckQuota() = %v, want allowed: %v", tt.name, err, tt.allowed)
+		}
+
+		if len(*counted) != 1 {
+			t.Fatalf("%s: usage counted %d times", tt.name, len(*counted))
+		}
+
+		if o := (*counted)[0]; o == nil || o.namespaces[0] != tt.namespace || o.exclude != tt.exclude {
+			t.Errorf("%s: usage counted for %+v, want namespace %d (exclude: %v)", tt.name, o, tt.namespace, tt.exclude)
+		}
+
+		restoreUsage()
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	var (
+		key   = &Claims{Quotas: map[string]uint64{QuotaRecords: 10}, Expires: at.AddDate(1, 0, 0)}
+		trial = &Claims{Trial: true, Quotas: map[string]uint64{QuotaRecords: 10}, Expires: at.AddDate(0, 0, 10)}
+	)
+
+	tests := []struct {
+		name     string
+		claims   *Claims
+		resource string
+		used     uint64
+		err      error
+		adding   uint64
+
+		// Expected error code, "" for none
+		code    string
+		counted bool
+	}{
+		{"under quota", key, QuotaRecords, 5, nil, 5, "", true},
+		{"over quota", key, QuotaRecords, 5, nil, 6, ErrCodeQuota, true},
+		{"trial, over quota", trial, QuotaRecords, 10, nil, 1, ErrCodeTrialQuota, true},
+		{"no quota", key, QuotaChannels, 1000, nil, 1, "", false},
+		{"no subscription", nil, QuotaRecords, 1000, nil, 1, "", false},
+		{"count failed", key, QuotaRecords, 0, errTestDB, 1, ErrQuotaCountFailed.Error(), true},
+	}
+
+	for _, tt := range tests {
+		_, restore := useSubscription(tt.claims)
+		if tt.claims == nil {
+			service.CurrentSubscription = nil
+		}
+
+		counted, restoreUsage := useUsage(map[string]uint64{tt.resource: tt.used}, tt.err)
+
+		var (
+			code string
+			err  = CheckQuota(context.Background(), tt.resource, tt.adding)
+		)
+
+		if e, ok := err.(*Error); ok {
+			code = e.Code
+		} else if err != nil {
+			code = err.Error()
+		}
+
+		if code != tt.code {
+			t.Errorf("%s: CheckQuota() = %q, want %q", tt.name, code, tt.code)
+		}
+
+		if (len(*counted) > 0) != tt.counted {
+			t.Errorf("%s: usage counted: %v, want %v", tt.name, len(*counted) > 0, tt.counted)
+		}
+
+		restoreUsage()
+		restore()
+	}
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	_, restore := useSubscription(&Claims{
+		Quotas:  map[string]uint64{QuotaModules: 10, QuotaStorageBytes: 100},
+		Expires: at.AddDate(1, 0, 0),
+	})
+	defer restore()
+
+	_, restoreUsage := useUsage(map[string]uint64{QuotaModules: 10, QuotaStorageBytes: 90}, nil)
+	defer restoreUsage()
+
+	const attachment = "/compose/namespace/1/module/2/record/attachment"
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		chunked bool
+
+		passed bool
+		code   string
+	}{
+		{name: "not consuming", method: "GET", path: "/compose/namespace/1/module/", passed: true},
+		{name: "not limited", method: "POST", path: "/compose/namespace/", passed: true},
+		{name: "quota reached", method: "POST", path: "/compose/namespace/1/module/", code: ErrCodeQuota},
+		{name: "upload under quota", method: "POST", path: attachment, body: strings.Repeat("x", 10), passed: true},
+		{name: "upload over quota", method: "POST", path: attachment, body: strings.Repeat("x", 11), code: ErrCodeQuota},
+		{name: "chunked upload under quota", method: "POST", path: attachment, body: strings.Repeat("x", 10), chunked: true, passed: true},
+		{name: "chunked upload over quota", method: "POST", path: attachment, body: strings.Repeat("x", 11), chunked: true, code: ErrCodeQuota},
+	}
+
+	for _, tt := range tests {
+		var (
+			body []byte
+
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		)
+
+		if tt.chunked {
+			r.ContentLength = -1
+			r.Body = ioutil.NopCloser(strings.NewReader(tt.body))
+		}
+
+		QuotaMiddleware(MonolithQuotas)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+		})).ServeHTTP(w, r)
+
+		if (body != nil) != tt.passed {
+			t.Errorf("%s: request passed: %v, want %v (response: %s)", tt.name, body != nil, tt.passed, w.Body.String())
+		}
+
+		if tt.passed && string(body) != tt.body {
+			t.Errorf("%s: handler read body %q, want %q", tt.name, body, tt.body)
+		}
+
+		if tt.code != "" && !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Errorf("%s: response %s, want error %q", tt.name, w.Body.String(), tt.code)
+		}
+	}
+}
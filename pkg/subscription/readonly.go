@@ -0,0 +1,67 @@
+package subscription
+
+import (
+	"net/http"
+)
+
+var (
+	// SystemWritable lists system routes that stay writable in read-only mode:
+	// login, logout and token exchange
+	SystemWritable = []string{
+		"/auth/internal/login",
+		"/auth/logout",
+		"/auth/exchange",
+	}
+
+	// MonolithWritable lists routes (as mounted by monolith.Configure) that stay writable in read-only mode
+	MonolithWritable = []string{
+		"/system/auth/internal/login",
+		"/system/auth/logout",
+		"/system/auth/exchange",
+	}
+)
+
+// ReadOnly returns middleware that rejects all mutating requests when
+// subscription is in read-only mode
+//
+// Requests to writable routes (login, logout...) are always allowed.
+// Websocket connections (GET) are allowed as well; changes made through
+// them are rejected by the services (see GuardServices).
+func ReadOnly(writable ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isSafeMethod(r.Method) || isWritable(writable, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if c := checker(r.Context()); c != nil {
+				if err := c.CanWrite(); err != nil {
+					writeError(w, r, err)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	return false
+}
+
+func isWritable(writable []string, path string) bool {
+	for _, prefix := range writable {
+		if matchPathPrefix(prefix, path) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package subscription
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	var (
+		at    = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+		grace = uint(7)
+	)
+
+	defer fixClock(at)()
+
+	var (
+		valid    = &Claims{Expires: at.AddDate(1, 0, 0)}
+		inGrace  = &Claims{Expires: at.AddDate(0, 0, -3), GraceDays: &grace}
+		readOnly = &Claims{Expires: at.AddDate(0, 0, -8), GraceDays: &grace}
+	)
+
+	tests := []struct {
+		name   string
+		claims *Claims
+		method string
+		path   string
+		passed bool
+	}{
+		{"valid", valid, "POST", "/compose/namespace/", true},
+		{"grace period", inGrace, "POST", "/compose/namespace/", true},
+		{"read-only", readOnly, "POST", "/compose/namespace/", false},
+		{"read-only, update", readOnly, "PUT", "/system/users/42", false},
+		{"read-only, delete", readOnly, "DELETE", "/messaging/channels/42", false},
+		{"read-only, read", readOnly, "GET", "/compose/namespace/", true},
+		{"read-only, websocket", readOnly, "GET", "/messaging/websocket", true},
+		{"read-only, options", readOnly, "OPTIONS", "/compose/namespace/", true},
+		{"read-only, login", readOnly, "POST", "/system/auth/internal/login", true},
+		{"read-only, logout", readOnly, "POST", "/system/auth/logout", true},
+		{"read-only, token exchange", readOnly, "POST", "/system/auth/exchange", true},
+		{"read-only, signup", readOnly, "POST", "/system/auth/internal/signup", false},
+		{"read-only, login prefix", readOnly, "POST", "/system/auth/internal/login-other", false},
+		{"invalid key", nil, "POST", "/compose/namespace/", true},
+	}
+
+	for _, tt := range tests {
+		_, restore := useSubscription(tt.claims)
+
+		var (
+			passed bool
+
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(tt.method, tt.path, nil)
+		)
+
+		ReadOnly(MonolithWritable...)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			passed = true
+		})).ServeHTTP(w, r)
+
+		if passed != tt.passed {
+			t.Errorf("%s: request passed: %v, want %v (response: %s)", tt.name, passed, tt.passed, w.Body.String())
+		}
+
+		if !tt.passed && !strings.Contains(w.Body.String(), `"code":"`+ErrCodeReadOnly+`"`) {
+			t.Errorf("%s: response %s, want error %q", tt.name, w.Body.String(), ErrCodeReadOnly)
+		}
+
+		restore()
+	}
+}
+
+// Monolith mounts system routes under /system
+func TestWritableRoutes(t *testing.T) {
+	if len(SystemWritable) != len(MonolithWritable) {
+		t.Fatalf("%d system writable routes, %d monolith writable routes", len(SystemWritable), len(MonolithWritable))
+	}
+
+	for i, path := range SystemWritable {
+		if MonolithWritable[i] != "/system"+path {
+			t.Errorf("monolith writable route %q, want %q", MonolithWritable[i], "/system"+path)
+		}
+
+		if !isWritable(SystemWritable, path) || !isWritable(MonolithWritable, "/system"+path) {
+			t.Errorf("route %q is not writable", path)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package subscription
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/markbates/goth"
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/system/repository"
+	"github.com/cortezaproject/corteza-server/system/service"
+	"github.com/cortezaproject/corteza-server/system/types"
+)
+
+type (
+	// How route that creates or reactivates users takes a seat
+	seatRule struct {
+		// Seat policies under which this route takes a seat w/o corteza checking it
+		checkUnder []string
+	}
+
+	// System user service that checks seats of the request's organisation
+	// and assigns users it creates to the organisation
+	guardedUsers struct {
+		service.UserService
+		ctx context.Context
+	}
+
+	// Subscription of the request that holds the seat reservation
+	seatReservation struct {
+		sync.Mutex
+		s *subscription
+	}
+
+	// System auth service that reserves a seat for users created on first
+	// external login, checks seats of the request's organisation and
+	// assigns users it signs up to the organisation
+	guardedAuth struct {
+		service.AuthService
+		ctx context.Context
+	}
+)
+
+const (
+	// Name of the database lock that serializes seat reservations
+	seatLockName = "crust-subscription.seats"
+)
+
+var (
+	ErrSeatReservationTimeout = errors.New("could not reserve subscription seat, please try again")
+	ErrSeatReservationFailed  = errors.New("could not reserve subscription seat")
+	ErrSeatCountFailed        = errors.New("could not count subscription seats")
+
+	// SystemSeats lists system routes that create or reactivate users
+	//
+	// Login with external provider creates user on first login;
+	// guarded auth service reserves a seat only then (see GuardServices)
+	// so that the reservation is not held during every external login
+	SystemSeats = Routes{
+		on(http.MethodPost, "/users/", seatRule{}),
+		on(http.MethodPost, "/users/*/unsuspend", seatRule{checkUnder: []string{SeatPolicyActive}}),
+		on(http.MethodPost, "/users/*/undelete", seatRule{checkUnder: []string{SeatPolicyActive, SeatPolicyHuman}}),
+		on(http.MethodPost, "/auth/internal/signup", seatRule{}),
+	}
+
+	// MonolithSeats lists routes as they are mounted by monolith.Configure
+	MonolithSeats = SystemSeats.Prefixed("/system")
+
+	// Subscription the seat is reserved for (see ReserveSeat)
+	//
+	// Reservation serializes user creation of all replicas, there is at most
+	// one at a time. Corteza checks seats w/o request context; with organisation
+	// subscriptions enabled, they are checked against this one.
+	reserved = &seatReservation{}
+)
+
+// SeatMiddleware reserves a seat for the duration of requests that create or reactivate users
+//
+// Corteza checks user limit before it creates the user, outside of the
+// transaction; holding the reservation until the request is done makes
+// check & create atomic across all replicas that share the database.
+//
+// Users are checked against seats of the request's organisation and assigned
+// to it by the guarded user & auth services (see GuardServices).
+func SeatMiddleware(rr Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ctx = r.Context()
+
+			for _, p := range rr.match(r) {
+				rule, ok := p.(seatRule)
+				if !ok {
+					continue
+				}
+
+				release, err := ReserveSeat(ctx)
+				if err != nil {
+					writeError(w, r, err)
+					return
+				}
+
+				defer release()
+
+				if err = checkSeat(ctx, rule.checkUnder); err != nil {
+					writeError(w, r, err)
+					return
+				}
+
+				break
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Checks if there is a free seat when the request's seat policy is one of the given
+func checkSeat(ctx context.Context, policies []string) error {
+	s := subscriptionFor(ctx)
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	var policy = s.seatPolicy
+	s.RUnlock()
+
+	for _, p := range policies {
+		if p == policy {
+			return s.checkSeats(ctx)
+		}
+	}
+
+	return nil
+}
+
+// ReserveSeat blocks until no one else is reserving a seat
+//
+// Reservation is a named database lock, held on a dedicated connection
+// so that it is shared by all replicas using the same database.
+// Caller should create the user and then release the reservation.
+//
+// Routes are covered by SeatMiddleware; anything else that
+// creates users (like CLI commands) should reserve a seat on its own.
+//
+// When lock can not be acquired ErrSeatReservationTimeout or
+// ErrSeatReservationFailed is returned; users must not be created then.
+func ReserveSeat(ctx context.Context) (release func(), err error) {
+	unlock, err := lockDB(ctx, seatLockName, opt.LockTimeout)
+	if err == errLockTimeout {
+		return nil, ErrSeatReservationTimeout
+	} else if err != nil {
+		logger.Error("could not reserve subscription seat", zap.Error(err))
+		return nil, ErrSeatReservationFailed
+	}
+
+	reserved.set(subscriptionFor(ctx))
+
+	return func() {
+		reserved.set(nil)
+		unlock()
+	}, nil
+}
+
+func (r *seatReservation) set(s *subscription) {
+	r.Lock()
+	defer r.Unlock()
+	r.s = s
+}
+
+// Returns subscription the seat is reserved for, nil when seat is not reserved
+func (r *seatReservation) get() *subscription {
+	r.Lock()
+	defer r.Unlock()
+	return r.s
+}
+
+// Checks if user with the email exists
+func userExists(ctx context.Context, email string) (bool, error) {
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return false, err
+	}
+
+	_, err = repository.User(ctx, db).FindByEmail(email)
+	if repository.ErrUserNotFound.Eq(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Checks if user that logs in with external provider exists, same as corteza
+// does: by valid credentials of a valid user or by the email
+func externalUserExists(ctx context.Context, profile goth.User) (bool, error) {
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return false, err
+	}
+
+	cc, err := repository.Credentials(ctx, db).FindByCredentials(profile.Provider, profile.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range cc {
+		if !c.Valid() {
+			continue
+		}
+
+		if u, err := repository.User(ctx, db).FindByID(c.OwnerID); err == nil && u.Valid() {
+			return true, nil
+		}
+	}
+
+	return userExists(ctx, profile.Email)
+}
+
+func (svc guardedUsers) With(ctx context.Context) service.UserService {
+	return guardedUsers{svc.UserService.With(ctx), ctx}
+}
+
+func (svc guardedUsers) Create(input *types.User) (*types.User, error) {
+	if opt.Tenants {
+		if err := svc.check(input); err != nil {
+			return nil, err
+		}
+	}
+
+	return svc.UserService.Create(input)
+}
+
+func (svc guardedUsers) CreateWithAvatar(input *types.User, avatar io.Reader) (*types.User, error) {
+	if opt.Tenants {
+		if err := svc.check(input); err != nil {
+			return nil, err
+		}
+	}
+
+	return svc.UserService.CreateWithAvatar(input, avatar)
+}
+
+// Checks seats of the request's organisation and assigns new user to it
+func (svc guardedUsers) check(input *types.User) error {
+	if s := subscriptionFor(svc.ctx); s != nil {
+		if err := s.checkSeats(svc.ctx); err != nil {
+			return localize(svc.ctx, err)
+		}
+	}
+
+	if input.OrganisationID == 0 {
+		input.OrganisationID = organisationOf(svc.ctx)
+	}
+
+	return nil
+}
+
+func (svc guardedAuth) With(ctx context.Context) service.AuthService {
+	return guardedAuth{svc.AuthService.With(ctx), ctx}
+}
+
+// External reserves a seat when user logs in with external provider
+// for the first time and is created
+func (svc guardedAuth) External(profile goth.User) (*types.User, error) {
+	exists, err := externalUserExists(svc.ctx, profile)
+	if err != nil {
+		return nil, err
+	} else if exists {
+		return svc.AuthService.External(profile)
+	}
+
+	release, err := ReserveSeat(svc.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	return svc.signUp(func() (*types.User, error) {
+		return svc.AuthService.External(profile)
+	})
+}
+
+// CanRegister checks seats of the request's organisation
+//
+// Corteza's check (made w/o request context) is used outside
+// of the seat reservation (see reserved)
+func (svc guardedAuth) CanRegister() error {
+	if !opt.Tenants {
+		return svc.AuthService.CanRegister()
+	}
+
+	s := subscriptionFor(svc.ctx)
+	if s == nil {
+		return nil
+	}
+
+	used, err := s.seatsUsed(svc.ctx)
+	if err != nil {
+		logger.Error("could not count subscription seats", zap.Error(err))
+		return ErrSeatCountFailed
+	}
+
+	return localize(svc.ctx, s.canRegister(used))
+}
+
+// InternalSignUp expects seat to be reserved by SeatMiddleware
+func (svc guardedAuth) InternalSignUp(input *types.User, password string) (*types.User, error) {
+	if !opt.Tenants {
+		return svc.AuthService.InternalSignUp(input, password)
+	}
+
+	exists, err := userExists(svc.ctx, input.Email)
+	if err != nil {
+		return nil, err
+	} else if exists {
+		return svc.AuthService.InternalSignUp(input, password)
+	}
+
+	return svc.signUp(func() (*types.User, error) {
+		return svc.AuthService.InternalSignUp(input, password)
+	})
+}
+
+// Checks seats of the request's organisation before a new user signs up
+// and assigns user created by signUp to the organisation
+//
+// Only with organisation subscriptions enabled; corteza checks seats of
+// the current subscription on its own otherwise. Corteza creates signed-up
+// users on its own; they are recognised by the creation time, set when
+// user is stored.
+func (svc guardedAuth) signUp(signUp func() (*types.User, error)) (*types.User, error) {
+	if !opt.Tenants {
+		return signUp()
+	}
+
+	if s := subscriptionFor(svc.ctx); s != nil {
+		if err := s.checkRegistration(svc.ctx); err != nil {
+			return nil, localize(svc.ctx, err)
+		}
+	}
+
+	var started = time.Now()
+
+	u, err := signUp()
+	if err != nil || u == nil || u.CreatedAt.Before(started) {
+		return u, err
+	}
+
+	if err = assignOrganisation(svc.ctx, u.ID, organisationOf(svc.ctx)); err != nil {
+		return nil, errors.Wrap(err, "could not assign user to organisation")
+	}
+
+	if u.OrganisationID == 0 {
+		u.OrganisationID = organisationOf(svc.ctx)
+	}
+
+	return u, nil
+}
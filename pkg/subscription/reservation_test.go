@@ -0,0 +1,254 @@
+package subscription
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeatChecks(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	var (
+		key   = &Claims{MaxUsers: 5, Expires: at.AddDate(1, 0, 0)}
+		trial = &Claims{Trial: true, MaxUsers: 5, Expires: at.AddDate(0, 0, 10)}
+	)
+
+	tests := []struct {
+		name   string
+		claims *Claims
+		used   uint
+		err    error
+
+		// Corteza's count of all users
+		total uint
+
+		// Expected error codes of CanCreateUser and checkSeats, "" for none
+		canCreate  string
+		checkSeats string
+	}{
+		{"free seat", key, 4, nil, 100, "", ""},
+		{"no free seat", key, 5, nil, 0, ErrCodeUserLimit, ErrCodeUserLimit},
+		{"trial, no free seat", trial, 5, nil, 0, ErrCodeTrialUserLimit, ErrCodeTrialUserLimit},
+		{"not limited", &Claims{Expires: at.AddDate(1, 0, 0)}, 1000, nil, 1000, "", ""},
+		{"invalid key", nil, 0, nil, 0, ErrCodeInvalidKey, ErrCodeInvalidKey},
+		{"count failed, total under limit", key, 0, errTestDB, 4, "", ErrSeatCountFailed.Error()},
+		{"count failed, total over limit", key, 0, errTestDB, 5, ErrCodeUserLimit, ErrSeatCountFailed.Error()},
+	}
+
+	code := func(err error) string {
+		if e, ok := err.(*Error); ok {
+			return e.Code
+		} else if err != nil {
+			return err.Error()
+		}
+
+		return ""
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, restore := useSubscription(tt.claims)
+			defer restore()
+			defer useSeats(tt.used, tt.err)()
+
+			if got := code(s.CanCreateUser(tt.total)); got != tt.canCreate {
+				t.Errorf("CanCreateUser(%d) = %q, want %q", tt.total, got, tt.canCreate)
+			}
+
+			if got := code(s.checkSeats(context.Background())); got != tt.checkSeats {
+				t.Errorf("checkSeats() = %q, want %q", got, tt.checkSeats)
+			}
+		})
+	}
+}
+
+func TestRegistrationChecks(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	s, restore := useSubscription(&Claims{MaxUsers: 5, Expires: at.AddDate(1, 0, 0)})
+	defer restore()
+
+	tests := []struct {
+		name  string
+		used  uint
+		err   error
+		total uint
+		can   bool
+		check bool
+	}{
+		{"free seat", 4, nil, 100, true, true},
+		{"no free seat", 5, nil, 0, false, false},
+		{"count failed", 0, errTestDB, 4, true, false},
+	}
+
+	for _, tt := range tests {
+		restoreSeats := useSeats(tt.used, tt.err)
+
+		if err := s.CanRegister(tt.total); (err == nil) != tt.can {
+			t.Errorf("%s: CanRegister(%d) = %v, want allowed: %v", tt.name, tt.total, err, tt.can)
+		}
+
+		if err := s.checkRegistration(context.Background()); (err == nil) != tt.check {
+			t.Errorf("%s: checkRegistration() = %v, want allowed: %v", tt.name, err, tt.check)
+		}
+
+		restoreSeats()
+	}
+}
+
+func TestSeatMiddleware(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		policy string
+		used   uint
+		err    error
+
+		// Seat lock is held by someone else, can not be taken
+		held    bool
+		lockErr error
+
+		reserved bool
+		passed   bool
+		response string
+	}{
+		{name: "not creating users", method: "GET", path: "/users/", passed: true},
+		{name: "create user", method: "POST", path: "/users/", reserved: true, passed: true},
+		{name: "create user, full", method: "POST", path: "/users/", used: 5, reserved: true, passed: true},
+		{name: "sign up", method: "POST", path: "/auth/internal/signup", reserved: true, passed: true},
+		{name: "reserved by someone else", method: "POST", path: "/users/", held: true, response: ErrSeatReservationTimeout.Error()},
+		{name: "lock failed", method: "POST", path: "/users/", lockErr: errTestDB, response: ErrSeatReservationFailed.Error()},
+		{name: "unsuspend", method: "POST", path: "/users/42/unsuspend", reserved: true, passed: true},
+		{name: "unsuspend, full", method: "POST", path: "/users/42/unsuspend", used: 5, reserved: true, response: ErrCodeUserLimit},
+		{name: "unsuspend, count failed", method: "POST", path: "/users/42/unsuspend", err: errTestDB, reserved: true, response: ErrSeatCountFailed.Error()},
+		{name: "unsuspend, suspended take seats", method: "POST", path: "/users/42/unsuspend", policy: SeatPolicyHuman, used: 5, reserved: true, passed: true},
+		{name: "undelete, full", method: "POST", path: "/users/42/undelete", policy: SeatPolicyHuman, used: 5, reserved: true, response: ErrCodeUserLimit},
+		{name: "undelete, deleted take seats", method: "POST", path: "/users/42/undelete", policy: SeatPolicyAll, used: 5, reserved: true, passed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restore := useSubscription(&Claims{MaxUsers: 5, SeatPolicy: tt.policy, Expires: at.AddDate(1, 0, 0)})
+			defer restore()
+			defer useSeats(tt.used, tt.err)()
+
+			locks, restoreLocks := useTestLocks()
+			defer restoreLocks()
+
+			locks.err = tt.lockErr
+			if tt.held {
+				locks.held[seatLockName] = true
+			}
+
+			var (
+				passed   bool
+				reserved bool
+
+				w = httptest.NewRecorder()
+				r = httptest.NewRequest(tt.method, tt.path, nil)
+			)
+
+			SeatMiddleware(SystemSeats)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				passed = true
+				reserved = locks.isHeld(seatLockName)
+			})).ServeHTTP(w, r)
+
+			if passed != tt.passed {
+				t.Errorf("request passed: %v, want %v (response: %s)", passed, tt.passed, w.Body.String())
+			}
+
+			if passed && reserved != tt.reserved {
+				t.Errorf("seat reserved during request: %v, want %v", reserved, tt.reserved)
+			}
+
+			if !tt.held && locks.isHeld(seatLockName) {
+				t.Errorf("seat reservation not released")
+			}
+
+			if tt.response != "" && !strings.Contains(w.Body.String(), tt.response) {
+				t.Errorf("response %s does not contain %q", w.Body.String(), tt.response)
+			}
+		})
+	}
+}
+
+func TestTenantSeatChecks(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+	opt.Tenants = true
+
+	s, restore := useSubscription(&Claims{MaxUsers: 5, Expires: at.AddDate(1, 0, 0)})
+	defer restore()
+
+	var tenant = &subscription{}
+	tenant.Update(&Claims{MaxUsers: 2, Expires: at.AddDate(1, 0, 0)})
+	defer useTenants(map[uint64]*subscription{7: tenant})()
+
+	_, restoreLocks := useTestLocks()
+	defer restoreLocks()
+
+	var prevCount = countSeats
+	defer func() { countSeats = prevCount }()
+
+	// Installation has a free seat, organisation does not
+	countSeats = func(_ context.Context, organisationID uint64, _ string) (uint, error) {
+		return map[uint64]uint{0: 1, 7: 2}[organisationID], nil
+	}
+
+	var tenantCtx = context.WithValue(context.Background(), tenantCtxKey{}, tenant)
+
+	tests := []struct {
+		name string
+
+		// Context of the seat reservation, nil when seat is not reserved
+		ctx     context.Context
+		allowed bool
+	}{
+		{"not reserved", nil, true},
+		{"reserved for installation", context.Background(), true},
+		{"reserved for organisation", tenantCtx, false},
+	}
+
+	for _, tt := range tests {
+		var release = func() {}
+		if tt.ctx != nil {
+			var err error
+			if release, err = ReserveSeat(tt.ctx); err != nil {
+				t.Fatalf("%s: ReserveSeat() = %v", tt.name, err)
+			}
+		}
+
+		// Total of all users is not used with organisation subscriptions
+		if err := s.CanCreateUser(100); (err == nil) != tt.allowed {
+			t.Errorf("%s: CanCreateUser() = %v, want allowed: %v", tt.name, err, tt.allowed)
+		}
+
+		if err := s.CanRegister(100); (err == nil) != tt.allowed {
+			t.Errorf("%s: CanRegister() = %v, want allowed: %v", tt.name, err, tt.allowed)
+		}
+
+		release()
+
+		if reserved.get() != nil {
+			t.Errorf("%s: seat reservation not cleared on release", tt.name)
+		}
+	}
+
+	if err := (guardedAuth{ctx: tenantCtx}).CanRegister(); err == nil {
+		t.Errorf("guardedAuth.CanRegister() allowed registration to organisation w/o free seats")
+	}
+
+	if err := (guardedAuth{ctx: context.Background()}).CanRegister(); err != nil {
+		t.Errorf("guardedAuth.CanRegister() = %v, want registration allowed", err)
+	}
+}
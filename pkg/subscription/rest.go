@@ -0,0 +1,213 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory/resputil"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+var (
+	ErrNoStatusPermission  = errors.New("not allowed to read subscription status")
+	ErrNoInstallPermission = errors.New("not allowed to install subscription key")
+	ErrNoAuditPermission   = errors.New("not allowed to read subscription events")
+)
+
+// MountRoutes mounts subscription management routes
+//
+// Current subscription and its status are reported for the request's
+// organisation when it has its own subscription.
+//
+// Expected to be registered through cli.Config's ApiServerRoutes
+func MountRoutes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(resolveTenant)
+		r.Get("/subscription/current", restCurrent)
+
+		r.Group(func(r chi.Router) {
+			r.Use(auth.MiddlewareValidOnly)
+
+			r.Get("/subscription/status", restStatus)
+			r.Put("/subscription/key", restInstall)
+			r.Get("/subscription/audit", restAudit)
+		})
+	})
+}
+
+// Responds with subscription error (or warning) for the current user & domain
+//
+// Same as system's /subscription/ route but with all error fields
+// (code, severity, audience, params) exposed
+func restCurrent(w http.ResponseWriter, r *http.Request) {
+	var (
+		// Anyone that has access permissions is considered admin
+		isAdmin = service.DefaultAccessControl.CanAccess(r.Context())
+	)
+
+	if c := checker(r.Context()); c != nil {
+		if err := c.Validate(requestDomain(r), isAdmin); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	resputil.JSON(w, resputil.OK())
+}
+
+// Responds with status of the current subscription
+func restStatus(w http.ResponseWriter, r *http.Request) {
+	var ctx = r.Context()
+
+	if !service.DefaultAccessControl.CanAccess(ctx) {
+		resputil.JSON(w, ErrNoStatusPermission)
+		return
+	}
+
+	resputil.JSON(w, currentStatus(ctx, requestDomain(r)))
+}
+
+// Validates and stores subscription key and responds with the new status
+//
+// Expects JSON payload with key: { "key": "<subscription-jwt>" }
+func restInstall(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx     = r.Context()
+		payload = struct {
+			Key string `json:"key"`
+		}{}
+	)
+
+	if !service.DefaultAccessControl.CanManageSettings(ctx) {
+		resputil.JSON(w, ErrNoInstallPermission)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resputil.JSON(w, errors.Wrap(err, "could not decode payload"))
+		return
+	}
+
+	if source := overridingSource(); source != "" {
+		resputil.JSON(w, errors.Errorf("subscription key is provided by %s and can not be changed", source))
+		return
+	}
+
+	key := strings.TrimSpace(payload.Key)
+	claims, err := parseInstalled(ctx, key)
+	if err != nil {
+		resputil.JSON(w, err)
+		return
+	}
+
+	v := &settings.Value{Name: settingSubscriptionJwtKey}
+	if err = v.SetValue(key); err != nil {
+		resputil.JSON(w, err)
+		return
+	}
+
+	if err = settingsSvc.Set(ctx, v); err != nil {
+		resputil.JSON(w, err)
+		return
+	}
+
+	// Apply immediately, no need to wait for the watcher
+	watched.set(key)
+	setActiveSource(SourceSettings)
+	UpdateCurrent(claims)
+	audit(ctx, AuditKeyInstalled, claims, "subscription key installed")
+	logger.Info("subscription key installed", zap.Uint64("userID", auth.GetIdentityFromContext(ctx).Identity()))
+
+	resputil.JSON(w, currentStatus(ctx, requestDomain(r)))
+}
+
+// Responds with recorded subscription events
+//
+// Supports event, since (RFC3339) and limit query params
+func restAudit(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context()
+		q   = r.URL.Query()
+		f   = AuditFilter{Event: q.Get("event")}
+		err error
+	)
+
+	if !service.DefaultAccessControl.CanAccess(ctx) {
+		resputil.JSON(w, ErrNoAuditPermission)
+		return
+	}
+
+	if since := q.Get("since"); since != "" {
+		if f.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			resputil.JSON(w, errors.Wrap(err, "invalid since param"))
+			return
+		}
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		var l uint64
+		if l, err = strconv.ParseUint(limit, 10, 32); err != nil {
+			resputil.JSON(w, errors.Wrap(err, "invalid limit param"))
+			return
+		}
+
+		f.Limit = uint(l)
+	}
+
+	ee, err := AuditEvents(ctx, f)
+	if err != nil {
+		resputil.JSON(w, err)
+		return
+	}
+
+	resputil.JSON(w, ee)
+}
+
+// Returns status of the subscription the request is evaluated against
+func currentStatus(ctx context.Context, domain string) *Status {
+	var s = subscriptionFor(ctx)
+	if s == nil {
+		return &Status{State: StateInvalid, Domains: []string{}}
+	}
+
+	var seatsUsed *uint
+	if used, err := s.seatsUsed(ctx); err != nil {
+		logger.Warn("could not count subscription seats", zap.Error(err))
+	} else {
+		seatsUsed = &used
+	}
+
+	st := s.Status(domain, seatsUsed)
+	st.OrganisationID = s.organisationID
+	st.Source = Source()
+	if s.organisationID > 0 {
+		// Organisation keys are always stored in settings
+		st.Source = SourceSettings
+	}
+
+	st.SessionsActive = sessions.count(ctx, s.organisationID)
+
+	if id, err := InstallationID(ctx); err != nil {
+		logger.Warn("could not load installation ID", zap.Error(err))
+	} else {
+		st.InstallationID = id
+	}
+
+	if key, err := InstallationPublicKey(ctx); err != nil {
+		logger.Warn("could not load installation public key", zap.Error(err))
+	} else {
+		st.InstallationPublicKey = key
+	}
+
+	return st
+}
@@ -0,0 +1,227 @@
+package subscription
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// Route matches requests by method and path and carries a payload
+	// for the middleware that guards the route (see FeatureMiddleware,
+	// QuotaMiddleware, SeatMiddleware and SessionMiddleware)
+	//
+	// Paths can contain "*" segments that match any single path segment
+	Route struct {
+		// Request method, any method when empty
+		method string
+
+		path string
+
+		// Path is a prefix (see matchPathPrefix), not the whole path
+		prefix bool
+
+		// Required feature, consumed quota, seat rule or session kind;
+		// each middleware looks only at payloads of its own type
+		payload interface{}
+	}
+
+	// Routes is a table of guarded routes
+	Routes []Route
+
+	// Feature that route requires
+	requiredFeature string
+)
+
+var (
+	// ComposeRoutes lists compose routes that require a feature
+	ComposeRoutes = Routes{
+		under("/", requiredFeature(FeatureCompose)),
+		under("/namespace/*/automation/", requiredFeature(FeatureAutomation)),
+	}
+
+	// MessagingRoutes lists messaging routes that require a feature
+	MessagingRoutes = Routes{
+		under("/", requiredFeature(FeatureMessaging)),
+	}
+
+	// SystemRoutes lists system routes that require a feature
+	SystemRoutes = Routes{
+		under("/automation/", requiredFeature(FeatureAutomation)),
+		under("/auth/external/", requiredFeature(FeatureExternalAuth)),
+		under("/sink", requiredFeature(FeatureApiSinks)),
+	}
+
+	// MonolithRoutes lists routes as they are mounted by monolith.Configure
+	MonolithRoutes = join(
+		ComposeRoutes.Prefixed("/compose"),
+		MessagingRoutes.Prefixed("/messaging"),
+		SystemRoutes.Prefixed("/system"),
+	)
+)
+
+// Route that matches requests with the given method to the given path
+func on(method, path string, payload interface{}) Route {
+	return Route{method: method, path: path, payload: payload}
+}
+
+// Route that matches requests with any method to the given path prefix
+func under(prefix string, payload interface{}) Route {
+	return Route{path: prefix, prefix: true, payload: payload}
+}
+
+// Joins route tables
+func join(rr ...Routes) (out Routes) {
+	for _, r := range rr {
+		out = append(out, r...)
+	}
+
+	return
+}
+
+// Prefixed returns copy of routes with prefix added to all paths
+func (rr Routes) Prefixed(prefix string) Routes {
+	var out = make(Routes, len(rr))
+	for i := range rr {
+		out[i] = rr[i]
+		out[i].path = prefix + rr[i].path
+	}
+
+	return out
+}
+
+// Returns payloads of all routes that match the request, in table order
+func (rr Routes) match(r *http.Request) (pp []interface{}) {
+	for i := range rr {
+		if rr[i].matches(r) {
+			pp = append(pp, rr[i].payload)
+		}
+	}
+
+	return
+}
+
+func (rt Route) matches(r *http.Request) bool {
+	if rt.method != "" && rt.method != r.Method {
+		return false
+	}
+
+	if rt.prefix {
+		return matchPathPrefix(rt.path, r.URL.Path)
+	}
+
+	return matchPath(rt.path, r.URL.Path)
+}
+
+// Features returns all features that are required for the request
+func (rr Routes) Features(r *http.Request) (ff []string) {
+	for _, p := range rr.match(r) {
+		if f, ok := p.(requiredFeature); ok {
+			ff = append(ff, string(f))
+		}
+	}
+
+	return
+}
+
+// FeatureMiddleware rejects requests to routes that subscription is not entitled to
+func FeatureMiddleware(rr Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c := checker(r.Context()); c != nil {
+				for _, f := range rr.Features(r) {
+					if err := c.IsEntitled(f); err != nil {
+						writeError(w, r, err)
+						return
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GuardRoutes wraps mounters so that all their routes are guarded by the given middlewares
+//
+// Middlewares check the subscription of the request's organisation
+// (when it has one, see SUBSCRIPTION_TENANTS) or the current subscription.
+//
+// Expected to be used on cli.Config's ApiServerRoutes, before any routes are mounted:
+//
+//	cfg.ApiServerRoutes = subscription.GuardRoutes(
+//		cfg.ApiServerRoutes,
+//		subscription.FeatureMiddleware(subscription.MonolithRoutes),
+//		subscription.QuotaMiddleware(subscription.MonolithQuotas),
+//	)
+func GuardRoutes(mm cli.Mounters, middlewares ...func(http.Handler) http.Handler) cli.Mounters {
+	return cli.Mounters{
+		func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(resolveTenant)
+				r.Use(middlewares...)
+				mm.MountRoutes(r)
+			})
+		},
+	}
+}
+
+// Returns checker of the request's organisation subscription or
+// current subscription checker; nil when there is none
+func checker(ctx context.Context) SubscriptionChecker {
+	if t, ok := ctx.Value(tenantCtxKey{}).(*subscription); ok {
+		return t
+	}
+
+	c, _ := service.CurrentSubscription.(SubscriptionChecker)
+	return c
+}
+
+// Checks if path starts with prefix, segment by segment
+//
+// Prefix that ends with "/" matches the path with all of its sub-paths,
+// otherwise the whole path must match.
+func matchPathPrefix(prefix, path string) bool {
+	if !strings.HasSuffix(prefix, "/") {
+		return matchPath(prefix, path)
+	}
+
+	var (
+		pp = strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+		ss = strings.Split(path, "/")
+	)
+
+	return len(ss) > len(pp) && matchSegments(pp, ss[:len(pp)])
+}
+
+// Checks if path matches pattern, segment by segment
+//
+// Trailing slash is significant, "/channels/" does not match "/channels"
+func matchPath(pattern, path string) bool {
+	var (
+		pp = strings.Split(pattern, "/")
+		ss = strings.Split(path, "/")
+	)
+
+	return len(ss) == len(pp) && matchSegments(pp, ss)
+}
+
+// Compares segments, pattern segment "*" matches any non-empty segment
+func matchSegments(pp, ss []string) bool {
+	for i := range pp {
+		if pp[i] == "*" && ss[i] != "" {
+			continue
+		}
+
+		if pp[i] != ss[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,40 @@
+package subscription
+
+import (
+	"testing"
+)
+
+func TestMatchPathPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		// Whole path
+		{"/channels", "/channels", true},
+		{"/channels", "/channels/", false},
+		{"/channels", "/channels/42", false},
+		{"/channels", "/channel", false},
+		{"/channels/*/members", "/channels/42/members", true},
+		{"/channels/*/members", "/channels//members", false},
+		{"/channels/*/members", "/channels/42/members/7", false},
+
+		// Path with sub-paths
+		{"/auth/", "/auth/", true},
+		{"/auth/", "/auth/check", true},
+		{"/auth/", "/auth/external/google/callback", true},
+		{"/auth/", "/auth", false},
+		{"/auth/", "/authorize", false},
+		{"/auth/", "/authx/check", false},
+		{"/namespace/*/module/", "/namespace/1/module/2/record/", true},
+		{"/namespace/*/module/", "/namespace//module/2", false},
+		{"/namespace/*/module/", "/namespace/1/page/2", false},
+		{"/", "/anything", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchPathPrefix(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("matchPathPrefix(%q, %q) = %v, want %v", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
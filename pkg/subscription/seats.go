@@ -0,0 +1,107 @@
+package subscription
+
+import (
+	"context"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/titpetric/factory"
+
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+	"github.com/cortezaproject/corteza-server/system/types"
+)
+
+type (
+	// SeatMetrics is a breakdown of users that (can) take subscription seats
+	SeatMetrics struct {
+		Total     uint `json:"total"`
+		Deleted   uint `json:"deleted"`
+		Suspended uint `json:"suspended"`
+		Bots      uint `json:"bots"`
+
+		// Human users that are not deleted
+		Human uint `json:"human"`
+
+		// Human users that are not deleted or suspended
+		Active uint `json:"active"`
+	}
+)
+
+// Seat counting policies
+const (
+	// Only active (not deleted or suspended), human users take seats (default)
+	SeatPolicyActive = "active"
+
+	// Suspended human users take seats as well
+	SeatPolicyHuman = "human"
+
+	// All users, including deleted ones and bots, take seats
+	SeatPolicyAll = "all"
+)
+
+var (
+	seatCounters = squirrel.
+		Select(
+			"COUNT(*) AS total",
+			"COALESCE(SUM(IF(deleted_at IS NULL, 0, 1)), 0) AS deleted",
+			"COALESCE(SUM(IF(suspended_at IS NULL, 0, 1)), 0) AS suspended",
+			"COALESCE(SUM(IF(kind = '"+string(types.BotUser)+"', 1, 0)), 0) AS bots",
+			"COALESCE(SUM(IF(deleted_at IS NULL AND kind <> '"+string(types.BotUser)+"', 1, 0)), 0) AS human",
+			"COALESCE(SUM(IF(deleted_at IS NULL AND suspended_at IS NULL AND kind <> '"+string(types.BotUser)+"', 1, 0)), 0) AS active",
+		).
+		From("sys_user")
+)
+
+// Used returns number of seats taken under the given policy
+func (m SeatMetrics) Used(policy string) uint {
+	switch seatPolicy(policy) {
+	case SeatPolicyAll:
+		return m.Total
+	case SeatPolicyHuman:
+		return m.Human
+	default:
+		return m.Active
+	}
+}
+
+// Returns known seat policy or the default one
+func seatPolicy(policy string) string {
+	switch policy {
+	case SeatPolicyActive, SeatPolicyHuman, SeatPolicyAll:
+		return policy
+	default:
+		return SeatPolicyActive
+	}
+}
+
+// Collects seat metrics from the system database, optionally only for users that match the filter
+func seatMetrics(ctx context.Context, filter squirrel.Sqlizer) (*SeatMetrics, error) {
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return nil, err
+	}
+
+	var q = seatCounters
+	if filter != nil {
+		q = q.Where(filter)
+	}
+
+	m := &SeatMetrics{}
+	if err = rh.FetchOne(db.With(ctx), q, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Counts seats used under the given policy by users of the organisation
+// (see organisationSeats)
+//
+// Replaced in tests
+var countSeats = func(ctx context.Context, organisationID uint64, policy string) (uint, error) {
+	m, err := seatMetrics(ctx, organisationSeats(organisationID))
+	if err != nil {
+		return 0, err
+	}
+
+	return m.Used(policy), nil
+}
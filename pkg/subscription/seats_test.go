@@ -0,0 +1,128 @@
+package subscription
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSeatPolicies(t *testing.T) {
+	var m = SeatMetrics{Total: 10, Deleted: 2, Suspended: 3, Bots: 1, Human: 7, Active: 5}
+
+	tests := []struct {
+		policy string
+		want   uint
+	}{
+		{"", 5},
+		{SeatPolicyActive, 5},
+		{SeatPolicyHuman, 7},
+		{SeatPolicyAll, 10},
+		{"unknown", 5},
+	}
+
+	for _, tt := range tests {
+		if got := m.Used(tt.policy); got != tt.want {
+			t.Errorf("Used(%q) = %d, want %d", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestStatusSeats(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	s, restore := useSubscription(&Claims{MaxUsers: 5, Expires: at.AddDate(1, 0, 0)})
+	defer restore()
+
+	seats := func(n uint) *uint { return &n }
+
+	tests := []struct {
+		name  string
+		used  *uint
+		state string
+	}{
+		{"free seats", seats(4), StateValid},
+		{"seats exhausted", seats(5), StateSeatsExhausted},
+		{"unknown", nil, StateValid},
+	}
+
+	for _, tt := range tests {
+		st := s.Status("", tt.used)
+		if st.State != tt.state {
+			t.Errorf("%s: Status().State = %s, want %s", tt.name, st.State, tt.state)
+		}
+
+		if (st.SeatsUsed == nil) != (tt.used == nil) {
+			t.Errorf("%s: Status().SeatsUsed = %v, want %v", tt.name, st.SeatsUsed, tt.used)
+		}
+	}
+}
+
+func TestPublishStateSeats(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	_, restore := useSubscription(&Claims{MaxUsers: 5, Expires: at.AddDate(1, 0, 0)})
+	defer restore()
+
+	var prevBus = bus
+	bus = &eventBus{listeners: map[int]listener{}}
+	defer func() { bus = prevBus }()
+
+	tests := []struct {
+		name      string
+		used      uint
+		err       error
+		exhausted bool
+	}{
+		{"free seats", 4, nil, false},
+		{"count failed", 0, errTestDB, false},
+		{"seats exhausted", 5, nil, true},
+		{"count failed, keeps exhausted", 0, errTestDB, true},
+		{"seats freed", 3, nil, false},
+	}
+
+	for _, tt := range tests {
+		restoreSeats := useSeats(tt.used, tt.err)
+		publishState(context.Background())
+		restoreSeats()
+
+		if bus.last.seatsExhausted != tt.exhausted {
+			t.Errorf("%s: seats exhausted = %v, want %v", tt.name, bus.last.seatsExhausted, tt.exhausted)
+		}
+	}
+}
+
+func TestSeatsCollector(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	_, restore := useSubscription(&Claims{MaxUsers: 5, Expires: at.AddDate(1, 0, 0)})
+	defer restore()
+
+	tests := []struct {
+		name    string
+		used    uint
+		err     error
+		samples int
+	}{
+		{"counted", 4, nil, 1},
+		{"count failed", 0, errTestDB, 0},
+	}
+
+	for _, tt := range tests {
+		restoreSeats := useSeats(tt.used, tt.err)
+
+		var ch = make(chan prometheus.Metric, 1)
+		seatsCollector{}.Collect(ch)
+		close(ch)
+
+		if len(ch) != tt.samples {
+			t.Errorf("%s: collected %d samples, want %d", tt.name, len(ch), tt.samples)
+		}
+
+		restoreSeats()
+	}
+}
@@ -0,0 +1,146 @@
+package subscription
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/cobra"
+	"github.com/titpetric/factory/resputil"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/api"
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/cortezaproject/corteza-server/pkg/cli/options"
+	"github.com/cortezaproject/corteza-server/pkg/version"
+)
+
+type (
+	peerAddrCtxKey struct{}
+)
+
+// ServeAPI makes cli's serve-api command serve routes with Serve
+//
+// Expected to be called on the command that cli.Config's MakeCLI returns:
+//
+//	ctx := cli.Context()
+//	cmd := cfg.MakeCLI(ctx)
+//	subscription.ServeAPI(ctx, cmd, cfg)
+func ServeAPI(ctx context.Context, cmd *cobra.Command, c *cli.Config) {
+	for _, sub := range cmd.Commands() {
+		if sub.Name() == c.ApiServerCommandName {
+			sub.Run = func(*cobra.Command, []string) {
+				Serve(ctx, c)
+			}
+		}
+	}
+}
+
+// Serve starts HTTP server with REST API, same as corteza's api.Server does
+//
+// The only difference is that address of the connected peer is recorded
+// (see PeerAddress) before RealIP middleware replaces request's remote address
+// with the (client controlled) X-Real-IP or X-Forwarded-For value.
+func Serve(ctx context.Context, c *cli.Config) {
+	var (
+		log     = c.Log.Named("http")
+		httpOpt = options.HTTP(c.EnvPrefix)
+	)
+
+	log.Info("Starting HTTP server with REST API", zap.String("address", httpOpt.Addr))
+
+	resputil.SetConfig(resputil.Options{
+		Trace:  httpOpt.Tracing,
+		Logger: func(err error) {},
+	})
+
+	listener, err := net.Listen("tcp", httpOpt.Addr)
+	if err != nil {
+		log.Error("Can not start server", zap.Error(err))
+		return
+	}
+
+	go func() {
+		err = http.Serve(listener, apiHandler(log, httpOpt, c.ApiServerRoutes.MountRoutes))
+	}()
+	<-ctx.Done()
+
+	if err == nil {
+		err = ctx.Err()
+		if err == context.Canceled {
+			err = nil
+		}
+	}
+
+	log.Info("HTTP server stopped", zap.Error(err))
+}
+
+// Builds REST API handler
+//
+// Copy of router setup in api.Server.Serve of the vendored corteza-server
+// (v0.0.0-20200110160908-6f0a7efb96b4) with PeerAddress in front of api.Base;
+// compare with it when corteza-server is upgraded.
+func apiHandler(log *zap.Logger, httpOpt *options.HTTPOpt, mountRoutes func(chi.Router)) http.Handler {
+	router := chi.NewRouter()
+
+	router.Use(PeerAddress)
+	router.Use(api.Base(log)...)
+
+	if httpOpt.LogRequest {
+		router.Use(api.LogRequest)
+	}
+
+	if httpOpt.LogResponse {
+		router.Use(api.LogResponse)
+	}
+
+	router.Use(api.HandlePanic)
+
+	if httpOpt.EnablePanicReporting {
+		router.Use(api.Sentry())
+	}
+
+	if httpOpt.EnableMetrics {
+		router.Use(api.Middleware(httpOpt.MetricsServiceLabel))
+	}
+
+	router.Group(func(r chi.Router) {
+		r.Use(
+			auth.DefaultJwtHandler.HttpVerifier(),
+			auth.DefaultJwtHandler.HttpAuthenticator(),
+		)
+
+		mountRoutes(r)
+	})
+
+	if httpOpt.EnableMetrics {
+		api.Mount(router, httpOpt.MetricsUsername, httpOpt.MetricsPassword)
+	}
+
+	if httpOpt.EnableDebugRoute {
+		api.Debug(router)
+	}
+
+	if httpOpt.EnableVersionRoute {
+		router.Get("/version", version.HttpHandler)
+	}
+
+	return router
+}
+
+// PeerAddress records address of the connected peer in the request context
+//
+// Must run before any middleware that rewrites request's remote address.
+func PeerAddress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrCtxKey{}, r.RemoteAddr)))
+	})
+}
+
+// Returns address of the connected peer, empty when it was not recorded
+func peerAddress(ctx context.Context) string {
+	addr, _ := ctx.Value(peerAddrCtxKey{}).(string)
+	return addr
+}
@@ -0,0 +1,40 @@
+package subscription
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/cli/options"
+)
+
+func TestAPIHandlerPeerAddress(t *testing.T) {
+	var (
+		peer, remote string
+
+		handler = apiHandler(zap.NewNop(), &options.HTTPOpt{}, func(r chi.Router) {
+			r.Get("/test", func(w http.ResponseWriter, r *http.Request) {
+				peer, remote = peerAddress(r.Context()), r.RemoteAddr
+			})
+		})
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/test", nil)
+	)
+
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+
+	handler.ServeHTTP(w, r)
+
+	if peer != "10.0.0.1:1234" {
+		t.Errorf("peer address = %q, want address of the connected peer", peer)
+	}
+
+	if remote != "192.0.2.1" {
+		t.Errorf("remote address = %q, want forwarded address (RealIP)", remote)
+	}
+}
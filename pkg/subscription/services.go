@@ -0,0 +1,330 @@
+package subscription
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	compose "github.com/cortezaproject/corteza-server/compose/service"
+	composeTypes "github.com/cortezaproject/corteza-server/compose/types"
+	messaging "github.com/cortezaproject/corteza-server/messaging/service"
+	"github.com/cortezaproject/corteza-server/messaging/types"
+	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// Compose namespace service that assigns namespaces it creates to the request's organisation
+	guardedNamespaces struct {
+		compose.NamespaceService
+		ctx context.Context
+	}
+
+	// Compose record service that checks record quota before it creates records
+	guardedRecords struct {
+		compose.RecordService
+		ctx context.Context
+	}
+
+	// Messaging channel service that checks subscription before it changes anything
+	guardedChannels struct {
+		messaging.ChannelService
+		ctx context.Context
+	}
+
+	// Messaging message service that checks subscription before it changes anything
+	guardedMessages struct {
+		messaging.MessageService
+		ctx context.Context
+	}
+)
+
+// GuardServices wraps corteza services so that subscription is checked
+// on every change, not only on REST routes
+//
+// Websocket (messaging) calls services directly, with no route to guard;
+// records are created by imports too, not only by the record route.
+// System user & auth services check seats of the request's organisation
+// when organisation subscriptions are enabled; corteza checks seats w/o
+// request context. Compose namespace service records organisation of
+// the namespaces it creates, their resources count against its quotas.
+//
+// Expected to be registered through cli.Config's ApiServerPreRun, after
+// services are initialized and before API server is started
+func GuardServices(ctx context.Context, cmd *cobra.Command, c *cli.Config) error {
+	if _, guarded := compose.DefaultNamespace.(guardedNamespaces); !guarded && compose.DefaultNamespace != nil {
+		compose.DefaultNamespace = guardedNamespaces{compose.DefaultNamespace, context.Background()}
+	}
+
+	if _, guarded := compose.DefaultRecord.(guardedRecords); !guarded && compose.DefaultRecord != nil {
+		compose.DefaultRecord = guardedRecords{compose.DefaultRecord, context.Background()}
+	}
+
+	if _, guarded := messaging.DefaultChannel.(guardedChannels); !guarded && messaging.DefaultChannel != nil {
+		messaging.DefaultChannel = guardedChannels{messaging.DefaultChannel, context.Background()}
+	}
+
+	if _, guarded := messaging.DefaultMessage.(guardedMessages); !guarded && messaging.DefaultMessage != nil {
+		messaging.DefaultMessage = guardedMessages{messaging.DefaultMessage, context.Background()}
+	}
+
+	if _, guarded := service.DefaultUser.(guardedUsers); !guarded && service.DefaultUser != nil {
+		service.DefaultUser = guardedUsers{service.DefaultUser, context.Background()}
+	}
+
+	if _, guarded := service.DefaultAuth.(guardedAuth); !guarded && service.DefaultAuth != nil {
+		service.DefaultAuth = guardedAuth{service.DefaultAuth, context.Background()}
+	}
+
+	return nil
+}
+
+// Checks if subscription of the context (request's organisation or
+// the current one) allows changes
+func canWrite(ctx context.Context) error {
+	if c := checker(ctx); c != nil {
+		return localize(ctx, c.CanWrite())
+	}
+
+	return nil
+}
+
+// Returns subscription error with message in user's language
+func localize(ctx context.Context, err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Localize(userLanguage(ctx))
+	}
+
+	return err
+}
+
+func (svc guardedNamespaces) With(ctx context.Context) compose.NamespaceService {
+	return guardedNamespaces{svc.NamespaceService.With(ctx), ctx}
+}
+
+func (svc guardedNamespaces) Create(namespace *composeTypes.Namespace) (*composeTypes.Namespace, error) {
+	ns, err := svc.NamespaceService.Create(namespace)
+	if err != nil {
+		return ns, err
+	}
+
+	if err = assignNamespace(svc.ctx, ns.ID, organisationOf(svc.ctx)); err != nil {
+		return nil, errors.Wrap(err, "could not assign namespace to organisation")
+	}
+
+	return ns, nil
+}
+
+func (svc guardedRecords) With(ctx context.Context) compose.RecordService {
+	return guardedRecords{svc.RecordService.With(ctx), ctx}
+}
+
+func (svc guardedRecords) Create(record *composeTypes.Record) (*composeTypes.Record, error) {
+	if err := localize(svc.ctx, CheckQuota(svc.ctx, QuotaRecords, 1)); err != nil {
+		return nil, err
+	}
+
+	return svc.RecordService.Create(record)
+}
+
+// Import checks quota for all entries of the import session at once
+//
+// Caller does not report errors of the import; session is marked
+// as finished with the reason of the failure instead
+func (svc guardedRecords) Import(ses *compose.RecordImportSession, ssvc compose.ImportSessionService) error {
+	if ses.Decoder != nil && ses.Progress.StartedAt == nil {
+		if err := localize(svc.ctx, CheckQuota(svc.ctx, QuotaRecords, ses.Progress.EntryCount)); err != nil {
+			var fa = now()
+			ses.Progress.StartedAt = &fa
+			ses.Progress.FinishedAt = &fa
+			ses.Progress.Failed = ses.Progress.EntryCount
+			ses.Progress.FailReason = err.Error()
+			ssvc.SetRecordByID(svc.ctx, ses.SessionID, 0, 0, nil, &ses.Progress, nil)
+			return err
+		}
+	}
+
+	return svc.RecordService.Import(ses, ssvc)
+}
+
+func (svc guardedChannels) With(ctx context.Context) messaging.ChannelService {
+	return guardedChannels{svc.ChannelService.With(ctx), ctx}
+}
+
+func (svc guardedChannels) Create(ch *types.Channel) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	if err := localize(svc.ctx, CheckQuota(svc.ctx, QuotaChannels, 1)); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.Create(ch)
+}
+
+func (svc guardedChannels) Update(ch *types.Channel) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.Update(ch)
+}
+
+func (svc guardedChannels) InviteUser(channelID uint64, memberIDs ...uint64) (types.ChannelMemberSet, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.InviteUser(channelID, memberIDs...)
+}
+
+func (svc guardedChannels) AddMember(channelID uint64, memberIDs ...uint64) (types.ChannelMemberSet, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.AddMember(channelID, memberIDs...)
+}
+
+func (svc guardedChannels) DeleteMember(channelID uint64, memberIDs ...uint64) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.ChannelService.DeleteMember(channelID, memberIDs...)
+}
+
+func (svc guardedChannels) SetFlag(ID uint64, flag types.ChannelMembershipFlag) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.SetFlag(ID, flag)
+}
+
+func (svc guardedChannels) Archive(ID uint64) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.Archive(ID)
+}
+
+func (svc guardedChannels) Unarchive(ID uint64) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.Unarchive(ID)
+}
+
+func (svc guardedChannels) Delete(ID uint64) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.Delete(ID)
+}
+
+func (svc guardedChannels) Undelete(ID uint64) (*types.Channel, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.ChannelService.Undelete(ID)
+}
+
+func (svc guardedMessages) With(ctx context.Context) messaging.MessageService {
+	return guardedMessages{svc.MessageService.With(ctx), ctx}
+}
+
+func (svc guardedMessages) Create(m *types.Message) (*types.Message, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.MessageService.Create(m)
+}
+
+func (svc guardedMessages) Update(m *types.Message) (*types.Message, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.MessageService.Update(m)
+}
+
+func (svc guardedMessages) CreateWithAvatar(m *types.Message, avatar io.Reader) (*types.Message, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.MessageService.CreateWithAvatar(m, avatar)
+}
+
+func (svc guardedMessages) React(messageID uint64, reaction string) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.React(messageID, reaction)
+}
+
+func (svc guardedMessages) RemoveReaction(messageID uint64, reaction string) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.RemoveReaction(messageID, reaction)
+}
+
+func (svc guardedMessages) MarkAsRead(channelID, threadID, lastReadMessageID uint64) (uint64, uint32, uint32, error) {
+	if err := canWrite(svc.ctx); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return svc.MessageService.MarkAsRead(channelID, threadID, lastReadMessageID)
+}
+
+func (svc guardedMessages) Pin(messageID uint64) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.Pin(messageID)
+}
+
+func (svc guardedMessages) RemovePin(messageID uint64) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.RemovePin(messageID)
+}
+
+func (svc guardedMessages) Bookmark(messageID uint64) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.Bookmark(messageID)
+}
+
+func (svc guardedMessages) RemoveBookmark(messageID uint64) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.RemoveBookmark(messageID)
+}
+
+func (svc guardedMessages) Delete(messageID uint64) error {
+	if err := canWrite(svc.ctx); err != nil {
+		return err
+	}
+
+	return svc.MessageService.Delete(messageID)
+}
@@ -0,0 +1,120 @@
+package subscription
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	compose "github.com/cortezaproject/corteza-server/compose/service"
+	composeTypes "github.com/cortezaproject/corteza-server/compose/types"
+	messaging "github.com/cortezaproject/corteza-server/messaging/service"
+	"github.com/cortezaproject/corteza-server/messaging/types"
+)
+
+type (
+	// Record service that only counts calls
+	testRecords struct {
+		compose.RecordService
+		created  int
+		imported int
+	}
+
+	// Import session service that records stored progress
+	testImportSessions struct {
+		compose.ImportSessionService
+		progress *compose.RecordImportProgress
+	}
+
+	// Channel service that only counts calls
+	testChannels struct {
+		messaging.ChannelService
+		created int
+	}
+
+	testDecoder struct {
+		compose.Decoder
+	}
+)
+
+func (svc *testRecords) Create(r *composeTypes.Record) (*composeTypes.Record, error) {
+	svc.created++
+	return r, nil
+}
+
+func (svc *testRecords) Import(*compose.RecordImportSession, compose.ImportSessionService) error {
+	svc.imported++
+	return nil
+}
+
+func (svc *testImportSessions) SetRecordByID(_ context.Context, _, _, _ uint64, _ map[string]string, p *compose.RecordImportProgress, _ compose.Decoder) (*compose.RecordImportSession, error) {
+	svc.progress = p
+	return nil, nil
+}
+
+func (svc *testChannels) Create(ch *types.Channel) (*types.Channel, error) {
+	svc.created++
+	return ch, nil
+}
+
+func TestGuardedServiceQuotas(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	_, restore := useSubscription(&Claims{
+		Quotas:  map[string]uint64{QuotaRecords: 5, QuotaChannels: 5},
+		Expires: at.AddDate(1, 0, 0),
+	})
+	defer restore()
+
+	tests := []struct {
+		name    string
+		used    uint64
+		err     error
+		entries uint64
+
+		allowed bool
+
+		// Import checks all entries at once
+		imported bool
+	}{
+		{"under quota", 2, nil, 3, true, true},
+		{"import over quota", 2, nil, 4, true, false},
+		{"quota reached", 5, nil, 1, false, false},
+		{"count failed", 0, errTestDB, 1, false, false},
+	}
+
+	for _, tt := range tests {
+		_, restoreUsage := useUsage(map[string]uint64{QuotaRecords: tt.used, QuotaChannels: tt.used}, tt.err)
+
+		var (
+			records  = &testRecords{}
+			sessions = &testImportSessions{}
+			channels = &testChannels{}
+
+			ses = &compose.RecordImportSession{
+				Decoder:  testDecoder{},
+				Progress: compose.RecordImportProgress{EntryCount: tt.entries},
+			}
+
+			ctx = context.Background()
+		)
+
+		if _, err := (guardedRecords{records, ctx}).Create(&composeTypes.Record{}); (err == nil) != tt.allowed || (records.created == 1) != tt.allowed {
+			t.Errorf("%s: guardedRecords.Create() = %v, want allowed: %v", tt.name, err, tt.allowed)
+		}
+
+		if err := (guardedRecords{records, ctx}).Import(ses, sessions); (err == nil) != tt.imported || (records.imported == 1) != tt.imported {
+			t.Errorf("%s: guardedRecords.Import() = %v, want allowed: %v", tt.name, err, tt.imported)
+		}
+
+		if !tt.imported && (sessions.progress == nil || sessions.progress.FinishedAt == nil || sessions.progress.Failed != tt.entries) {
+			t.Errorf("%s: rejected import session not marked as failed: %+v", tt.name, sessions.progress)
+		}
+
+		if _, err := (guardedChannels{channels, ctx}).Create(&types.Channel{}); (err == nil) != tt.allowed || (channels.created == 1) != tt.allowed {
+			t.Errorf("%s: guardedChannels.Create() = %v, want allowed: %v", tt.name, err, tt.allowed)
+		}
+
+		restoreUsage()
+	}
+}
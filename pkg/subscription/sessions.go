@@ -0,0 +1,747 @@
+package subscription
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/jwtauth"
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+)
+
+type (
+	// What route does with the session: starts it (login), connects to it (websocket) or ends it
+	sessionKind int
+
+	// Concurrent session, identified by its hashed auth token
+	session struct {
+		ID       string    `db:"id"`
+		UserID   uint64    `db:"rel_user"`
+		Started  time.Time `db:"started_at"`
+		LastSeen time.Time `db:"last_seen"`
+
+		// Organisation whose subscription the session counts against, 0 for the current subscription
+		OrganisationID uint64 `db:"rel_organisation"`
+
+		// Expiration of the auth token; token of evicted session is rejected until then
+		Expires time.Time `db:"expires_at"`
+
+		Evicted *time.Time `db:"evicted_at"`
+	}
+
+	// Concurrent sessions
+	//
+	// Sessions are kept in the system database and shared by all replicas
+	// (and by system and messaging services); session limit applies to all
+	// of them together. Sessions of organisations with their own subscription
+	// are counted separately.
+	sessionRegistry struct {
+		sync.Mutex
+
+		// Sessions this replica recently marked as active, by hashed auth token
+		seen map[string]time.Time
+
+		// When were stale entries last removed from seen
+		seenPruned time.Time
+
+		// Open websocket connections of this replica, by hashed auth token
+		conns map[string]map[net.Conn]bool
+
+		// Starts syncConnections with the first websocket connection
+		syncOnce sync.Once
+	}
+
+	// Records connection that websocket upgrader takes over
+	hijackTracker struct {
+		http.ResponseWriter
+		onHijack func(net.Conn)
+	}
+
+	// Records status and body of the login response
+	loginRecorder struct {
+		http.ResponseWriter
+		status int
+		body   bytes.Buffer
+	}
+)
+
+const (
+	sessionLogin sessionKind = iota
+	sessionConnect
+	sessionLogout
+)
+
+const (
+	sessionsTable = "crust_subscription_sessions"
+
+	// Name of the database lock that serializes session registrations
+	sessionLockName = "crust-subscription.sessions"
+
+	// How long do we reject tokens of evicted sessions when token expiration is unknown
+	evictedRetention = 30 * 24 * time.Hour
+
+	// How often do we mark sessions as active in the database and look for
+	// websocket connections of sessions evicted by other replicas
+	sessionSyncInterval = 30 * time.Second
+)
+
+var (
+	ErrSessionUnavailable = errors.New("could not start session, please try again")
+
+	// SystemSessions lists system routes that start or end sessions
+	SystemSessions = Routes{
+		on(http.MethodPost, "/auth/internal/login", sessionLogin),
+		on(http.MethodPost, "/auth/internal/signup", sessionLogin),
+		on(http.MethodPost, "/auth/internal/confirm-email", sessionLogin),
+		on(http.MethodPost, "/auth/internal/exchange-password-reset-token", sessionLogin),
+		on(http.MethodPost, "/auth/exchange", sessionLogin),
+		on(http.MethodGet, "/auth/logout", sessionLogout),
+	}
+
+	// MessagingSessions lists messaging routes that connect to sessions
+	MessagingSessions = Routes{
+		on(http.MethodGet, "/websocket", sessionConnect),
+		on(http.MethodGet, "/websocket/", sessionConnect),
+	}
+
+	// MonolithSessions lists routes as they are mounted by monolith.Configure
+	MonolithSessions = join(
+		SystemSessions.Prefixed("/system"),
+		MessagingSessions.Prefixed("/messaging"),
+	)
+
+	// Table is created on start (see createTables)
+	sessionsTableDDL = `CREATE TABLE IF NOT EXISTS ` + sessionsTable + ` (
+  id               CHAR(64)        NOT NULL,
+  rel_user         BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  rel_organisation BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  started_at       DATETIME        NOT NULL,
+  last_seen        DATETIME        NOT NULL,
+  expires_at       DATETIME        NOT NULL,
+  evicted_at       DATETIME            NULL,
+  PRIMARY KEY (id),
+  KEY idx_organisation (rel_organisation, evicted_at, last_seen)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+	sessions = &sessionRegistry{
+		seen:  map[string]time.Time{},
+		conns: map[string]map[net.Conn]bool{},
+	}
+
+	sessionColumns = []string{
+		"id",
+		"rel_user",
+		"rel_organisation",
+		"started_at",
+		"last_seen",
+		"expires_at",
+		"evicted_at",
+	}
+)
+
+// Returns kind of the session route, -1 when request is not made to one
+func sessionRoute(rr Routes, r *http.Request) sessionKind {
+	for _, p := range rr.match(r) {
+		if k, ok := p.(sessionKind); ok {
+			return k
+		}
+	}
+
+	return -1
+}
+
+// SessionMiddleware enforces subscription's concurrent session limit
+//
+// Logins are rejected when all sessions are in use, unless eviction
+// is enabled (SUBSCRIPTION_SESSION_EVICT); then the oldest session is
+// ended to make room once login succeeds. Every authenticated request
+// keeps its session active; requests made with tokens of evicted sessions
+// are rejected.
+//
+// Websocket connections keep their session active while they are open
+// and are closed when session is evicted.
+//
+// Sessions are not tracked when subscription does not limit them.
+func SessionMiddleware(rr Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !sessionsLimited(r.Context()) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var (
+				ctx  = r.Context()
+				key  = sessionKey(ctx)
+				kind = sessionRoute(rr, r)
+			)
+
+			switch {
+			case kind == sessionLogin:
+				if err := sessions.check(ctx); err != nil {
+					writeError(w, r, err)
+					return
+				}
+
+				rec := &loginRecorder{ResponseWriter: w, status: http.StatusOK}
+				next.ServeHTTP(rec, r)
+
+				if token := rec.token(); token != "" {
+					sessions.login(ctx, token)
+				}
+
+				return
+
+			case kind == sessionLogout:
+				sessions.end(ctx, key)
+
+			case key != "":
+				if err := sessions.admit(ctx, key, kind == sessionConnect); err != nil {
+					writeError(w, r, err)
+					return
+				}
+			}
+
+			if kind == sessionConnect && key != "" {
+				var conn net.Conn
+
+				w = hijackTracker{w, func(c net.Conn) {
+					conn = c
+					sessions.attach(key, c)
+				}}
+
+				// Websocket handler returns when connection is closed
+				defer func() {
+					if conn != nil {
+						sessions.detach(key, conn)
+					}
+				}()
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Rejects login when all sessions are in use and eviction is disabled
+//
+// Called before credentials are checked so nothing is evicted here
+func (reg *sessionRegistry) check(ctx context.Context) error {
+	var c = checker(ctx)
+	if c == nil || opt.SessionEvict || !sessionsLimited(ctx) {
+		return nil
+	}
+
+	active, err := reg.active(ctx, organisationOf(ctx))
+	if err != nil {
+		logger.Warn("could not count sessions", zap.Error(err))
+		return ErrSessionUnavailable
+	}
+
+	if err = c.CanStartSession(uint(len(active))); err != nil {
+		auditLimited(ctx, AuditSessionLimitReached, nil, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Registers session of the successful login
+//
+// Oldest sessions are evicted when eviction is enabled; otherwise session
+// is registered even when limit was reached since the login was checked
+func (reg *sessionRegistry) login(ctx context.Context, token string) {
+	sum := sha256.Sum256([]byte(token))
+
+	var s = &session{ID: hex.EncodeToString(sum[:])}
+
+	if i, err := auth.DefaultJwtHandler.Decode(token); err == nil {
+		s.UserID = i.Identity()
+	}
+
+	var claims = jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err == nil {
+		s.Expires = claimsExpiry(claims)
+	}
+
+	if err := reg.register(ctx, s, true, false); err != nil {
+		logger.Warn("could not register session", zap.Error(err))
+	}
+}
+
+// Marks session as active, registers it when it is not known yet
+func (reg *sessionRegistry) admit(ctx context.Context, key string, connect bool) error {
+	reg.Lock()
+	var seen, ok = reg.seen[key]
+	reg.Unlock()
+
+	if ok && now().Sub(seen) < sessionSyncInterval {
+		return nil
+	}
+
+	db, err := systemDB(ctx)
+	if err != nil {
+		logger.Warn("could not load session", zap.Error(err))
+		return ErrSessionUnavailable
+	}
+
+	var (
+		stored = &session{}
+		q      = squirrel.
+			Select(sessionColumns...).
+			From(sessionsTable).
+			Where(squirrel.Eq{"id": key})
+	)
+
+	if err = rh.FetchOne(db, q, stored); err != nil && err != sql.ErrNoRows {
+		logger.Warn("could not load session", zap.Error(err))
+		return ErrSessionUnavailable
+	}
+
+	switch {
+	case stored.Evicted != nil:
+		reg.forget(key)
+
+		if s := subscriptionFor(ctx); s != nil {
+			return s.sessionEvicted()
+		}
+
+		return nil
+
+	case stored.ID != "":
+		if _, err = db.Exec("UPDATE "+sessionsTable+" SET last_seen = ? WHERE id = ?", now(), key); err != nil {
+			logger.Warn("could not mark session as active", zap.Error(err))
+		}
+
+		reg.markSeen(key)
+		return nil
+	}
+
+	// Tokens issued before sessions were tracked (or used after session was
+	// pruned as idle) start new sessions as well; we audit only new
+	// connections, not every request
+	return reg.register(ctx, &session{
+		ID:      key,
+		UserID:  auth.GetIdentityFromContext(ctx).Identity(),
+		Expires: tokenExpiry(ctx),
+	}, false, connect)
+}
+
+// Registers new session when subscription's session limit allows it
+//
+// Sessions are counted and registered while holding a database lock
+// so that concurrent logins on all replicas see each other. Oldest sessions
+// are evicted to make room when eviction is enabled. Forced session is
+// registered even when limit does not allow it. Audit events are recorded
+// after the lock is released.
+func (reg *sessionRegistry) register(ctx context.Context, s *session, force, auditRejection bool) error {
+	var (
+		c      = checker(ctx)
+		events []auditEntry
+	)
+
+	s.OrganisationID = organisationOf(ctx)
+	s.Started, s.LastSeen = now(), now()
+	if s.Expires.IsZero() {
+		s.Expires = now().Add(evictedRetention)
+	}
+
+	err := func() error {
+		release, err := lockDB(ctx, sessionLockName, opt.LockTimeout)
+		if err != nil {
+			logger.Warn("could not lock sessions", zap.Error(err))
+			return ErrSessionUnavailable
+		}
+
+		defer release()
+
+		db, err := systemDB(ctx)
+		if err != nil {
+			logger.Warn("could not register session", zap.Error(err))
+			return ErrSessionUnavailable
+		}
+
+		if err = pruneSessions(db); err != nil {
+			logger.Warn("could not prune sessions", zap.Error(err))
+		}
+
+		active, err := reg.active(ctx, s.OrganisationID)
+		if err != nil {
+			logger.Warn("could not count sessions", zap.Error(err))
+			return ErrSessionUnavailable
+		}
+
+		for _, a := range active {
+			if a.ID == s.ID {
+				// Registered by another request in the meantime
+				reg.markSeen(s.ID)
+				return nil
+			}
+		}
+
+		if c != nil {
+			evicted, err := pickEvictions(c, active, opt.SessionEvict)
+			if err != nil && !force {
+				if auditRejection {
+					events = append(events, auditEntry{AuditSessionLimitReached, err.Error(), true})
+				}
+
+				return err
+			}
+
+			for _, e := range evicted {
+				if err = reg.evict(db, e); err != nil {
+					logger.Warn("could not evict session", zap.Error(err))
+					continue
+				}
+
+				events = append(events, auditEntry{AuditSessionEvicted, "oldest session evicted, user: " + strconv.FormatUint(e.UserID, 10), false})
+			}
+		}
+
+		if err = db.Replace(sessionsTable, s); err != nil {
+			logger.Warn("could not register session", zap.Error(err))
+			return ErrSessionUnavailable
+		}
+
+		reg.markSeen(s.ID)
+		return nil
+	}()
+
+	for _, e := range events {
+		if e.limited {
+			auditLimited(ctx, e.event, nil, e.message)
+		} else {
+			audit(ctx, e.event, nil, e.message)
+		}
+	}
+
+	return err
+}
+
+// Picks sessions that need to be evicted so that a new session can start, oldest first
+//
+// Error is returned when subscription does not allow another session
+// and sessions can not be evicted
+func pickEvictions(c SubscriptionChecker, active []*session, evict bool) ([]*session, error) {
+	var oldest = make([]*session, len(active))
+	copy(oldest, active)
+
+	sort.SliceStable(oldest, func(i, j int) bool {
+		return oldest[i].Started.Before(oldest[j].Started)
+	})
+
+	for n := 0; ; n++ {
+		err := c.CanStartSession(uint(len(oldest) - n))
+		if err == nil {
+			return oldest[:n], nil
+		}
+
+		if !evict || n == len(oldest) {
+			return nil, err
+		}
+	}
+}
+
+// Ends session and closes its connections, token can not be used anymore
+func (reg *sessionRegistry) evict(db *factory.DB, s *session) error {
+	if _, err := db.Exec("UPDATE "+sessionsTable+" SET evicted_at = ? WHERE id = ?", now(), s.ID); err != nil {
+		return err
+	}
+
+	reg.forget(s.ID)
+	logger.Info("session evicted", zap.Uint64("userID", s.UserID))
+	return nil
+}
+
+// Forgets evicted session and closes its websocket connections
+func (reg *sessionRegistry) forget(key string) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	for c := range reg.conns[key] {
+		if err := c.Close(); err != nil {
+			logger.Debug("could not close evicted session connection", zap.Error(err))
+		}
+	}
+
+	delete(reg.conns, key)
+	delete(reg.seen, key)
+}
+
+// Records that session was marked as active in the database
+//
+// Stale entries are removed once per sync interval
+func (reg *sessionRegistry) markSeen(key string) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	var t = now()
+
+	if t.Sub(reg.seenPruned) >= sessionSyncInterval {
+		for k, seen := range reg.seen {
+			if t.Sub(seen) >= sessionSyncInterval {
+				delete(reg.seen, k)
+			}
+		}
+
+		reg.seenPruned = t
+	}
+
+	reg.seen[key] = t
+}
+
+// Removes sessions that were idle for too long and evicted sessions with expired tokens
+func pruneSessions(db *factory.DB) error {
+	var t = now()
+
+	_, err := db.Exec(
+		"DELETE FROM "+sessionsTable+" WHERE expires_at < ? OR (evicted_at IS NULL AND last_seen < ?)",
+		t,
+		t.Add(-opt.SessionIdleTimeout),
+	)
+
+	return err
+}
+
+// Ends session on logout
+func (reg *sessionRegistry) end(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+
+	reg.Lock()
+	delete(reg.seen, key)
+	reg.Unlock()
+
+	db, err := systemDB(ctx)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM "+sessionsTable+" WHERE id = ? AND evicted_at IS NULL", key)
+	}
+
+	if err != nil {
+		logger.Warn("could not end session", zap.Error(err))
+	}
+}
+
+// Attaches websocket connection to the session
+func (reg *sessionRegistry) attach(key string, c net.Conn) {
+	reg.syncOnce.Do(func() {
+		go reg.syncConnections(context.Background())
+	})
+
+	reg.Lock()
+	defer reg.Unlock()
+
+	if reg.conns[key] == nil {
+		reg.conns[key] = map[net.Conn]bool{}
+	}
+
+	reg.conns[key][c] = true
+}
+
+// Detaches closed websocket connection from the session
+func (reg *sessionRegistry) detach(key string, c net.Conn) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	delete(reg.conns[key], c)
+	if len(reg.conns[key]) == 0 {
+		delete(reg.conns, key)
+	}
+}
+
+// Keeps sessions with open websocket connections active and closes
+// connections of sessions that were evicted (by any replica)
+func (reg *sessionRegistry) syncConnections(ctx context.Context) {
+	var ticker = time.NewTicker(sessionSyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reg.Lock()
+		var keys = make([]string, 0, len(reg.conns))
+		for key := range reg.conns {
+			keys = append(keys, key)
+		}
+		reg.Unlock()
+
+		if len(keys) == 0 {
+			continue
+		}
+
+		if err := reg.syncKeys(ctx, keys); err != nil {
+			logger.Warn("could not sync session connections", zap.Error(err))
+		}
+	}
+}
+
+func (reg *sessionRegistry) syncKeys(ctx context.Context, keys []string) error {
+	db, err := systemDB(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		evicted = []string{}
+		q       = squirrel.
+			Select("id").
+			From(sessionsTable).
+			Where(squirrel.Eq{"id": keys}).
+			Where("evicted_at IS NOT NULL")
+	)
+
+	if err = rh.FetchAll(db, q, &evicted); err != nil {
+		return err
+	}
+
+	for _, key := range evicted {
+		reg.forget(key)
+	}
+
+	query, args, err := squirrel.
+		Update(sessionsTable).
+		Set("last_seen", now()).
+		Where(squirrel.Eq{"id": keys}).
+		Where("evicted_at IS NULL").
+		ToSql()
+
+	if err == nil {
+		_, err = db.Exec(query, args...)
+	}
+
+	return err
+}
+
+// Returns active sessions of the organisation (0 for the current subscription)
+func (reg *sessionRegistry) active(ctx context.Context, organisationID uint64) ([]*session, error) {
+	db, err := systemDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ss = make([]*session, 0)
+		q  = squirrel.
+			Select(sessionColumns...).
+			From(sessionsTable).
+			Where(squirrel.Eq{"rel_organisation": organisationID}).
+			Where("evicted_at IS NULL").
+			Where(squirrel.GtOrEq{"last_seen": now().Add(-opt.SessionIdleTimeout)})
+	)
+
+	return ss, rh.FetchAll(db, q, &ss)
+}
+
+// Returns number of active sessions of the organisation (0 for the current subscription)
+func (reg *sessionRegistry) count(ctx context.Context, organisationID uint64) uint {
+	ss, err := reg.active(ctx, organisationID)
+	if err != nil {
+		logger.Warn("could not count sessions", zap.Error(err))
+	}
+
+	return uint(len(ss))
+}
+
+// Hijack satisfies http.Hijacker and records the hijacked connection
+func (h hijackTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can not be hijacked")
+	}
+
+	c, rw, err := hj.Hijack()
+	if err == nil {
+		h.onHijack(c)
+	}
+
+	return c, rw, err
+}
+
+// WriteHeader records response status
+func (lr *loginRecorder) WriteHeader(status int) {
+	lr.status = status
+	lr.ResponseWriter.WriteHeader(status)
+}
+
+// Write records response body
+func (lr *loginRecorder) Write(b []byte) (int, error) {
+	lr.body.Write(b)
+	return lr.ResponseWriter.Write(b)
+}
+
+// Returns auth token of the successful login, empty when login failed
+func (lr *loginRecorder) token() string {
+	if lr.status < 200 || lr.status > 299 {
+		return ""
+	}
+
+	var rsp = struct {
+		JWT string `json:"jwt"`
+	}{}
+
+	if err := json.Unmarshal(lr.body.Bytes(), &rsp); err != nil {
+		return ""
+	}
+
+	return rsp.JWT
+}
+
+// Returns expiration of the request's auth token, zero when unknown
+func tokenExpiry(ctx context.Context) time.Time {
+	_, claims, _ := jwtauth.FromContext(ctx)
+	return claimsExpiry(claims)
+}
+
+// Returns expiration from auth token claims, zero when unknown
+func claimsExpiry(claims jwt.MapClaims) time.Time {
+	switch exp := claims["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0)
+	case json.Number:
+		if i, err := exp.Int64(); err == nil {
+			return time.Unix(i, 0)
+		}
+	}
+
+	return time.Time{}
+}
+
+// Does subscription the request is evaluated for limit concurrent sessions
+func sessionsLimited(ctx context.Context) bool {
+	var s = subscriptionFor(ctx)
+	if s == nil {
+		return false
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	return s.limitMaxSessions > 0
+}
+
+// Returns session key (hashed auth token) for the request, empty when not authenticated
+func sessionKey(ctx context.Context) string {
+	var token = auth.GetJwtFromContext(ctx)
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,171 @@
+package subscription
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+)
+
+func TestPickEvictions(t *testing.T) {
+	var (
+		at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		// Sessions started n minutes ago, in no particular order
+		sessions = func(mm ...int) []*session {
+			var ss = make([]*session, len(mm))
+			for i, m := range mm {
+				ss[i] = &session{ID: string(rune('a' + i)), Started: at.Add(-time.Duration(m) * time.Minute)}
+			}
+
+			return ss
+		}
+	)
+
+	tests := []struct {
+		name        string
+		maxSessions uint
+		active      []*session
+		evict       bool
+		want        []string
+		err         bool
+	}{
+		{"not limited", 0, sessions(3, 2, 1), false, []string{}, false},
+		{"under limit", 3, sessions(2, 1), false, []string{}, false},
+		{"no sessions", 1, nil, false, []string{}, false},
+		{"limit reached", 2, sessions(2, 1), false, nil, true},
+		{"limit reached, evict oldest", 2, sessions(1, 5), true, []string{"b"}, false},
+		{"over limit, evict oldest ones", 2, sessions(1, 5, 3, 4), true, []string{"b", "d", "c"}, false},
+		{"over limit", 2, sessions(1, 5, 3, 4), false, nil, true},
+		{"single session", 1, sessions(7), true, []string{"a"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				s = &subscription{isValid: true, limitMaxSessions: tt.maxSessions}
+			)
+
+			evicted, err := pickEvictions(s, tt.active, tt.evict)
+			if (err != nil) != tt.err {
+				t.Fatalf("pickEvictions() error = %v, want error: %v", err, tt.err)
+			}
+
+			if err != nil {
+				if e, ok := err.(*Error); !ok || e.Code != ErrCodeSessionLimit {
+					t.Errorf("pickEvictions() error = %v, want %s", err, ErrCodeSessionLimit)
+				}
+
+				return
+			}
+
+			var ids = make([]string, len(evicted))
+			for i, e := range evicted {
+				ids[i] = e.ID
+			}
+
+			if !equalStrings(ids, tt.want) {
+				t.Errorf("pickEvictions() evicted %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickEvictionsKeepsActive(t *testing.T) {
+	var (
+		at     = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+		active = []*session{
+			{ID: "new", Started: at},
+			{ID: "old", Started: at.Add(-time.Hour)},
+		}
+	)
+
+	if _, err := pickEvictions(&subscription{limitMaxSessions: 1}, active, true); err != nil {
+		t.Fatalf("pickEvictions() error = %v", err)
+	}
+
+	if active[0].ID != "new" || active[1].ID != "old" {
+		t.Errorf("pickEvictions() reordered active sessions")
+	}
+}
+
+func TestSessionMiddlewareNotLimited(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+	}{
+		{"login", "POST", "/auth/internal/login", ""},
+		{"logout", "GET", "/auth/logout", "token"},
+		{"authenticated request", "GET", "/users/", "token"},
+	}
+
+	for _, tt := range tests {
+		for _, maxSessions := range []uint{0, 2} {
+			_, restore := useSubscription(&Claims{MaxSessions: maxSessions, Expires: at.AddDate(1, 0, 0)})
+			locks, restoreLocks := useTestLocks()
+
+			var (
+				passed bool
+
+				w = httptest.NewRecorder()
+				r = httptest.NewRequest(tt.method, tt.path, nil)
+			)
+
+			if tt.token != "" {
+				r = r.WithContext(auth.SetJwtToContext(r.Context(), tt.token))
+			}
+
+			SessionMiddleware(SystemSessions)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				passed = true
+			})).ServeHTTP(w, r)
+
+			restoreLocks()
+			restore()
+
+			if maxSessions == 0 {
+				if !passed || len(locks.taken) > 0 {
+					t.Errorf("%s: sessions tracked w/o session limit (passed: %v, locks: %v)", tt.name, passed, locks.taken)
+				}
+
+				continue
+			}
+
+			// There is no database in tests, limited sessions can not be tracked
+			if tt.name != "logout" && (passed || !strings.Contains(w.Body.String(), ErrSessionUnavailable.Error())) {
+				t.Errorf("%s: sessions not tracked with session limit (passed: %v, response: %s)", tt.name, passed, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestMarkSeen(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	var reg = &sessionRegistry{seen: map[string]time.Time{}}
+
+	reg.markSeen("a")
+	reg.markSeen("b")
+
+	now = func() time.Time { return at.Add(sessionSyncInterval / 2) }
+	reg.markSeen("c")
+
+	if len(reg.seen) != 3 {
+		t.Errorf("markSeen() pruned entries within sync interval: %v", reg.seen)
+	}
+
+	now = func() time.Time { return at.Add(sessionSyncInterval) }
+	reg.markSeen("d")
+
+	if _, ok := reg.seen["a"]; ok || len(reg.seen) != 2 {
+		t.Errorf("markSeen() did not prune stale entries: %v", reg.seen)
+	}
+}
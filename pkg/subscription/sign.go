@@ -0,0 +1,86 @@
+//go:build signer
+// +build signer
+
+package subscription
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Sign creates subscription key (JWT) from claims, signed with the given private key
+//
+// Key ID (kid) is used to select public key when key is verified (see SUBSCRIPTION_KEYS_DIR);
+// it can not be empty as that would select the built-in key.
+//
+// Counterpart of parse(); intended for testing and for partners that issue on-premise keys.
+// Included only in builds with signer tag (see command_sign.go).
+func Sign(c *Claims, kid string, key *ecdsa.PrivateKey) (string, error) {
+	if kid == builtinKeyID {
+		return "", errors.New("key ID is required")
+	}
+
+	method, err := signingMethod(key)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, c)
+	token.Header["type"] = HEADER_TYPE
+	token.Header["kid"] = kid
+
+	return token.SignedString(key)
+}
+
+// Reads PEM encoded ECDSA private key
+func readPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read private key")
+	}
+
+	return jwt.ParseECPrivateKeyFromPEM(buf)
+}
+
+// Writes public key to the keys directory (<kid>.pem) so that
+// server trusts it (see initKeyring)
+func writeTrustedKey(dir, kid string, key *ecdsa.PublicKey) (string, error) {
+	if dir == "" {
+		return "", errors.New("keys directory not set (SUBSCRIPTION_KEYS_DIR)")
+	}
+
+	pem, err := encodePublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, kid+keyFileExt)
+	return path, ioutil.WriteFile(path, []byte(pem), 0640)
+}
+
+// Selects ES* signing method by key's curve
+func signingMethod(key *ecdsa.PrivateKey) (jwt.SigningMethod, error) {
+	if key == nil {
+		return nil, errors.New("no private key")
+	}
+
+	switch key.Curve.Params().BitSize {
+	case 256:
+		return jwt.SigningMethodES256, nil
+	case 384:
+		return jwt.SigningMethodES384, nil
+	case 521:
+		return jwt.SigningMethodES512, nil
+	default:
+		return nil, errors.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	}
+}
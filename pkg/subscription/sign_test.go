@@ -0,0 +1,136 @@
+//go:build signer
+// +build signer
+
+package subscription
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	dir, err := ioutil.TempDir("", "crust-keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var prevKeyring = trusted
+	defer func() { trusted = prevKeyring }()
+
+	tests := []struct {
+		name  string
+		curve elliptic.Curve
+		kid   string
+		valid bool
+	}{
+		{"P-256", elliptic.P256(), "partner-256", true},
+		{"P-384", elliptic.P384(), "partner-384", true},
+		{"P-521", elliptic.P521(), "partner-521", true},
+		{"unsupported curve", elliptic.P224(), "partner-224", false},
+		{"no key ID", elliptic.P256(), builtinKeyID, false},
+	}
+
+	for _, tt := range tests {
+		key, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := Sign(&Claims{ID: tt.kid, MaxUsers: 5, Expires: at.AddDate(1, 0, 0)}, tt.kid, key)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: Sign() = %v, want valid: %v", tt.name, err, tt.valid)
+		}
+
+		if !tt.valid {
+			continue
+		}
+
+		if _, err = writeTrustedKey(dir, tt.kid, &key.PublicKey); err != nil {
+			t.Fatalf("%s: writeTrustedKey() = %v", tt.name, err)
+		}
+
+		// Server trusts keys from the keys directory
+		trusted = newKeyring()
+		if err = trusted.addDir(dir); err != nil {
+			t.Fatalf("%s: addDir() = %v", tt.name, err)
+		}
+
+		c, err := parse(signed)
+		if err != nil {
+			t.Errorf("%s: parse() = %v", tt.name, err)
+		} else if c.ID != tt.kid || c.MaxUsers != 5 {
+			t.Errorf("%s: parse() = %+v, want signed claims", tt.name, c)
+		}
+	}
+}
+
+func TestSignUntrusted(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	_, restore := useTestSettings(nil)
+	defer restore()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Signed with an untrusted key under ID of a trusted one
+	signed, err := Sign(&Claims{Expires: at.AddDate(1, 0, 0)}, testKeyID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = parse(signed); err == nil {
+		t.Errorf("parse() accepted key signed with untrusted private key")
+	}
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crust-keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalECPrivateKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		valid   = filepath.Join(dir, "valid.pem")
+		invalid = filepath.Join(dir, "invalid.pem")
+	)
+
+	_ = ioutil.WriteFile(valid, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(invalid, []byte("not a key"), 0600)
+
+	if key, err := readPrivateKey(valid); err != nil || key.D.Cmp(testKey.D) != 0 {
+		t.Errorf("readPrivateKey() = %v, want test key", err)
+	}
+
+	if _, err := readPrivateKey(invalid); err == nil {
+		t.Errorf("readPrivateKey() read invalid key")
+	}
+
+	if _, err := readPrivateKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("readPrivateKey() read missing key")
+	}
+
+	if _, err := writeTrustedKey("", "partner", &testKey.PublicKey); err == nil {
+		t.Errorf("writeTrustedKey() wrote key w/o keys directory")
+	}
+}
@@ -0,0 +1,97 @@
+package subscription
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+)
+
+// Subscription key sources, in order of precedence
+const (
+	SourceFile     = "file"
+	SourceEnv      = "env"
+	SourceSettings = "settings"
+	SourceTrial    = "trial"
+)
+
+var (
+	activeSource = struct {
+		sync.RWMutex
+		name string
+	}{}
+)
+
+// Source returns name of the source that current subscription was loaded from
+func Source() string {
+	activeSource.RLock()
+	defer activeSource.RUnlock()
+	return activeSource.name
+}
+
+func setActiveSource(source string) {
+	activeSource.Lock()
+	defer activeSource.Unlock()
+	activeSource.name = source
+}
+
+// Loads raw subscription key from the first non-empty source
+//
+// Precedence: file (SUBSCRIPTION_KEY_FILE), environment (SUBSCRIPTION_KEY), settings.
+// When none of them holds a key, empty key is returned with trial as the source.
+func loadKey(ctx context.Context) (key, source string, err error) {
+	if opt.KeyFile != "" {
+		if key, err = readKeyFile(opt.KeyFile); err != nil || key != "" {
+			return key, SourceFile, err
+		}
+	}
+
+	if opt.Key != "" {
+		return strings.TrimSpace(opt.Key), SourceEnv, nil
+	}
+
+	if settingsSvc != nil {
+		ctx = auth.SetSuperUserContext(ctx)
+
+		if v, err := settingsSvc.Get(ctx, settingSubscriptionJwtKey, 0); err != nil {
+			return "", SourceSettings, err
+		} else if key = v.String(); key != "" {
+			// Value.String() is nil-safe
+			return key, SourceSettings, nil
+		}
+	}
+
+	return "", SourceTrial, nil
+}
+
+// Reads key from file; missing file is treated as empty key
+func readKeyFile(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "could not read subscription key file")
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// Returns source that overrides subscription key stored in settings (if any)
+func overridingSource() string {
+	if opt.KeyFile != "" {
+		if key, _ := readKeyFile(opt.KeyFile); key != "" {
+			return SourceFile
+		}
+	}
+
+	if opt.Key != "" {
+		return SourceEnv
+	}
+
+	return ""
+}
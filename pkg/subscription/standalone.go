@@ -0,0 +1,71 @@
+package subscription
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/cli"
+	"github.com/cortezaproject/corteza-server/pkg/cli/options"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// Allows access to settings to super user only
+	superUserOnly struct{}
+)
+
+const (
+	systemSettingsTable = "sys_settings"
+)
+
+// Standalone initializes subscription in binaries that run without
+// system service (compose, messaging)
+//
+// Subscription key (and everything else) is read directly from system's
+// tables. System database is configured with SYSTEM_DB_DSN and defaults to
+// DB_DSN, same as in the system service.
+//
+// Expected to be registered through cli.Config's ApiServerPreRun
+func Standalone(ctx context.Context, cmd *cobra.Command, c *cli.Config) error {
+	if service.CurrentSubscription != nil {
+		// Already initialized
+		return nil
+	}
+
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		// Not connected to the system database yet
+		factory.Database.Add("system", options.DB("system").DSN)
+
+		if db, err = factory.Database.Get("system"); err != nil {
+			return err
+		}
+	}
+
+	Init(c.Log, settings.NewService(
+		settings.NewRepository(db, systemSettingsTable),
+		c.Log,
+		superUserOnly{},
+		// Nothing to keep current, subscription reads settings on its own
+		&struct{}{},
+	))
+
+	logger.Debug("subscription initialized in standalone mode", zap.String("service", c.ServiceName))
+
+	UpdateCurrent(Load(ctx))
+	Watch(ctx)
+	return nil
+}
+
+func (superUserOnly) CanReadSettings(ctx context.Context) bool {
+	return auth.IsSuperUser(auth.GetIdentityFromContext(ctx))
+}
+
+func (superUserOnly) CanManageSettings(ctx context.Context) bool {
+	return auth.IsSuperUser(auth.GetIdentityFromContext(ctx))
+}
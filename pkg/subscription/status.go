@@ -0,0 +1,130 @@
+package subscription
+
+import (
+	"sort"
+	"time"
+)
+
+type (
+	// Status describes current state of the subscription
+	Status struct {
+		State          string    `json:"state"`
+		InstallationID string    `json:"installationID"`
+		Source         string    `json:"source"`
+		Valid          bool      `json:"valid"`
+		Trial          bool      `json:"trial"`
+		Domains        []string  `json:"domains"`
+		DomainMatch    bool      `json:"domainMatch"`
+		Expires        time.Time `json:"expires"`
+		DaysLeft       int       `json:"daysLeft"`
+		GraceDays      uint      `json:"graceDays"`
+		ReadOnly       bool      `json:"readOnly"`
+		SeatsLimit     uint      `json:"seatsLimit"`
+		SeatPolicy     string    `json:"seatPolicy"`
+
+		// Seats used under seat policy, null when seats could not be counted
+		SeatsUsed *uint `json:"seatsUsed"`
+
+		// Public key of the installation (PEM), usage reports are signed with it
+		InstallationPublicKey string `json:"installationPublicKey"`
+
+		// Organisation with its own subscription, 0 for the current subscription
+		OrganisationID uint64 `json:"organisationID,string"`
+
+		// Concurrent sessions (of all replicas), limit is 0 when not limited
+		SessionsActive uint `json:"sessionsActive"`
+		SessionsLimit  uint `json:"sessionsLimit"`
+
+		// Entitled features, empty when subscription includes all of them
+		Entitlements []string `json:"entitlements"`
+
+		// Resource quotas, resources w/o quota are not limited
+		Quotas map[string]uint64 `json:"quotas"`
+
+		// Values used in subscription messages
+		Branding Branding `json:"branding"`
+	}
+)
+
+// Machine readable subscription states, ordered by importance;
+// only the most important one is reported
+const (
+	StateInvalid        = "invalid"
+	StateDomainMismatch = "domain-mismatch"
+	StateReadOnly       = "read-only"
+	StateTrialExpired   = "trial-expired"
+	StateExpired        = "expired"
+	StateSeatsExhausted = "seats-exhausted"
+	StateTrialExpiring  = "trial-expiring"
+	StateExpiring       = "expiring"
+	StateTrial          = "trial"
+	StateValid          = "valid"
+)
+
+// Status returns current state of subscription for the given domain and number of used seats
+//
+// Seats are not considered in the state when number of used seats is not known (nil)
+func (s *subscription) Status(domain string, seatsUsed *uint) *Status {
+	s.RLock()
+	defer s.RUnlock()
+
+	var (
+		st = &Status{
+			Valid:       s.isValid,
+			Trial:       s.isTrial,
+			Domains:     s.domains,
+			DomainMatch: s.isValidDomain(domain),
+			Expires:     s.expires,
+			DaysLeft:    Claims{Expires: s.expires}.DaysLeft(),
+			GraceDays:   s.graceDays,
+			ReadOnly:    s.isReadOnly(),
+			SeatsUsed:   seatsUsed,
+			SeatsLimit:  s.limitMaxUsers,
+			SeatPolicy:  s.seatPolicy,
+
+			SessionsLimit: s.limitMaxSessions,
+			Branding:      s.brand(),
+		}
+	)
+
+	if st.Domains == nil {
+		st.Domains = []string{}
+	}
+
+	st.Entitlements = make([]string, 0, len(s.entitlements))
+	for e := range s.entitlements {
+		st.Entitlements = append(st.Entitlements, e)
+	}
+
+	sort.Strings(st.Entitlements)
+
+	st.Quotas = make(map[string]uint64, len(s.quotas))
+	for r, q := range s.quotas {
+		st.Quotas[r] = q
+	}
+
+	switch true {
+	case !s.isValid:
+		st.State = StateInvalid
+	case !st.DomainMatch:
+		st.State = StateDomainMismatch
+	case st.ReadOnly:
+		st.State = StateReadOnly
+	case s.isTrial && st.DaysLeft <= 0:
+		st.State = StateTrialExpired
+	case st.DaysLeft <= 0:
+		st.State = StateExpired
+	case s.limitMaxUsers > 0 && seatsUsed != nil && *seatsUsed >= s.limitMaxUsers:
+		st.State = StateSeatsExhausted
+	case s.isTrial && st.DaysLeft <= warnTrialDaysLimit:
+		st.State = StateTrialExpiring
+	case !s.isTrial && st.DaysLeft <= warnAdminDaysLimit:
+		st.State = StateExpiring
+	case s.isTrial:
+		st.State = StateTrial
+	default:
+		st.State = StateValid
+	}
+
+	return st
+}
@@ -1,29 +1,56 @@
 package subscription
 
 import (
-	"errors"
+	"context"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 type (
 	subscription struct {
 		sync.RWMutex
 
+		// Organisation this subscription is for, 0 for the current subscription
+		organisationID uint64
+
+		id            string
 		domains       []string
 		expires       time.Time
 		limitMaxUsers uint
+		seatPolicy    string
 		isTrial       bool
 		isValid       bool
+
+		// Max number of concurrent sessions, 0 when not limited
+		limitMaxSessions uint
+
+		// Entitled features, nil when subscription is not limited to any
+		entitlements map[string]bool
+
+		// Resource quotas, resources w/o quota are not limited
+		quotas map[string]uint64
+
+		// Number of days after expiration before we switch to read-only mode
+		graceDays uint
+
+		// Branding from claims, overrides configured branding
+		branding Branding
 	}
 
 	SubscriptionChecker interface {
 		Validate(string, bool) error
 		CanCreateUser(uint) error
 		CanRegister(uint) error
+		IsEntitled(string) error
+		CanUse(string, uint64, uint64) error
+		CanWrite() error
+		CanStartSession(uint) error
 	}
 )
 
@@ -34,6 +61,7 @@ var (
 )
 
 const (
+	// Default contact address, see Branding
 	salesEmail = "sales@crust.tech"
 
 	// If less then this amount of days we'll show admins a warning
@@ -45,47 +73,66 @@ const (
 	// If we got trial subscription w/o max-user limit, this
 	// is the fallback number
 	limitMaxUsersTrialDefault = 10
-
-	// See subscription struct's functions on how & where these strings are used
-	willExpire      = `This Crust subscription will expire on [exp-date]. Please contact [sales-email] to renew the subscription.`
-	hasExpired      = `This Crust subscription has expired. Please contact your administrator or [sales-email] to renew the subscription.`
-	trialWillExpire = `This Crust trial will expire on [exp-date]. To convert this trial in a to a subscription, please contact [sales-email].`
-	trialHasExpired = `Your Crust trial has expired. Please contact [sales-email] to learn how to convert this trial in to a Crust subscription.`
-	invalidKey      = `Unverified or invalid subscription key. Please contact your administrator or [sales-email].`
-
-	trialAddUserError = `The Crust trial is limited to [user-limit] user(s). If you need more users, please contact us at [sales-email].`
-	addUserError      = `Your subscription user limit has been reached. Please contact [sales-email] to learn how to increase the number of users.`
-	signupError       = `Registration is disabled at the moment. Please contact your administrator.`
 )
 
-// Update updates subscription data with new values
-func (s *subscription) Update(domains []string, expires time.Time, isTrial bool, limitMaxUsers uint) {
+// Update updates subscription data with new values from claims
+func (s *subscription) Update(c *Claims) {
 	s.Lock()
 	defer s.Unlock()
 
-	s.domains = domains
-	s.expires = expires
-	s.isTrial = isTrial
+	s.id = c.ID
+	s.domains = c.Domains
+	s.expires = c.Expires
+	s.isTrial = c.Trial
 	s.isValid = true
 
-	if limitMaxUsers == 0 && isTrial {
+	if c.MaxUsers == 0 && c.Trial {
 		// Trial w/o user limit?
 		// set to default
 		s.limitMaxUsers = limitMaxUsersTrialDefault
 	} else {
-		s.limitMaxUsers = limitMaxUsers
+		s.limitMaxUsers = c.MaxUsers
 	}
+
+	s.seatPolicy = seatPolicy(c.SeatPolicy)
+	s.limitMaxSessions = c.MaxSessions
+
+	s.entitlements = nil
+	if len(c.Entitlements) > 0 {
+		s.entitlements = make(map[string]bool)
+		for _, e := range c.Entitlements {
+			s.entitlements[e] = true
+		}
+	}
+
+	s.quotas = nil
+	if len(c.Quotas) > 0 {
+		s.quotas = make(map[string]uint64)
+		for r, q := range c.Quotas {
+			s.quotas[r] = q
+		}
+	}
+
+	s.graceDays = c.gracePeriod()
+	s.branding = c.Branding
 }
 
 func (s *subscription) Reset() {
 	s.Lock()
 	defer s.Unlock()
 
+	s.id = ""
 	s.domains = nil
 	s.expires = time.Time{}
 	s.limitMaxUsers = 0
+	s.seatPolicy = ""
+	s.limitMaxSessions = 0
 	s.isTrial = false
 	s.isValid = false
+	s.entitlements = nil
+	s.quotas = nil
+	s.graceDays = 0
+	s.branding = Branding{}
 }
 
 // Validate checks domain and expiration date
@@ -100,6 +147,11 @@ func (s *subscription) Reset() {
 // but just warnings. Nevertheless we always return an error for consistency
 // and simpler func signature
 func (s *subscription) Validate(domain string, isAdmin bool) error {
+	if t := s.tenant(tenants.byDomain(domain)); t != nil {
+		// Domain belongs to an organisation with its own subscription
+		return t.Validate(domain, isAdmin)
+	}
+
 	s.RLock()
 	defer s.RUnlock()
 
@@ -108,35 +160,49 @@ func (s *subscription) Validate(domain string, isAdmin bool) error {
 		daysLeft = math.Floor(s.expires.Sub(now()).Hours() / 24)
 	)
 
+	if s.isValid && !s.isValidDomain(domain) {
+		domainMismatchCounter.Inc()
+	}
+
 	switch true {
 	case !s.isValid || !s.isValidDomain(domain):
 		return s.error(invalidKey)
 
+	case s.isTrial && daysLeft <= 0:
+		return s.expiredError(trialHasExpired)
+
 	case s.isTrial && daysLeft <= warnTrialDaysLimit:
 		return s.error(trialWillExpire)
 
-	case s.isTrial && daysLeft <= 0:
-		return s.error(trialHasExpired)
+	case daysLeft <= 0:
+		return s.expiredError(hasExpired)
 
 	case daysLeft <= warnAdminDaysLimit && isAdmin:
 		return s.error(willExpire)
 
-	case daysLeft <= 0:
-		return s.error(hasExpired)
-
 	default:
 		return nil
 	}
 }
 
-// Validates domain against
+// Expiration errors become blocking when subscription is in read-only mode
+func (s *subscription) expiredError(m message) *Error {
+	e := s.error(m)
+	if s.isReadOnly() {
+		e.Severity = SeverityBlocking
+	}
+
+	return e
+}
+
+// Validates domain against subscription's domain patterns
 func (s *subscription) isValidDomain(domain string) bool {
 	if len(s.domains) == 0 {
 		return true
 	}
 
 	for _, d := range s.domains {
-		if d == domain {
+		if matchDomain(d, domain) {
 			return true
 		}
 	}
@@ -144,8 +210,68 @@ func (s *subscription) isValidDomain(domain string) bool {
 	return false
 }
 
+// Returns specificity of subscription's domain pattern that matches the domain best,
+// -1 when subscription is not restricted to domains or none of them matches
+// (see domainSpecificity)
+func (s *subscription) domainMatch(domain string) int {
+	var best = -1
+	for _, d := range s.domains {
+		if m := domainSpecificity(d, domain); m > best {
+			best = m
+		}
+	}
+
+	return best
+}
+
 // CanCreateUser - Does subscription allow us to create new user
+//
+// Given total (all users, counted by corteza) is used only when seats can
+// not be counted under subscription's seat policy
+//
+// With organisation subscriptions enabled, seats are checked against subscription
+// the seat is reserved for (see reserved); total counts users of all organisations
+// and is not used then
 func (s *subscription) CanCreateUser(currentTotal uint) error {
+	if t := s.seatSubscription(); t != nil {
+		return t.checkSeats(context.Background())
+	}
+
+	return s.checkCreateUser(context.Background(), s.seatsUsedOr(currentTotal))
+}
+
+// Checks if there is a free seat for a new user
+//
+// Unlike CanCreateUser, it fails when seats can not be counted
+func (s *subscription) checkSeats(ctx context.Context) error {
+	used, err := s.seatsUsed(ctx)
+	if err != nil {
+		logger.Error("could not count subscription seats", zap.Error(err))
+		return ErrSeatCountFailed
+	}
+
+	return s.checkCreateUser(ctx, used)
+}
+
+func (s *subscription) checkCreateUser(ctx context.Context, used uint) error {
+	err := s.canCreateUser(used)
+	if e, ok := err.(*Error); ok {
+		userCreationBlockedCounter.WithLabelValues(e.Code).Inc()
+	}
+
+	if e, ok := err.(*Error); ok && (e.Code == ErrCodeUserLimit || e.Code == ErrCodeTrialUserLimit) {
+		audit(ctx, AuditSeatLimitReached, s.claims(), e.Message)
+
+		if s.organisationID == 0 {
+			// Let listeners know right away, w/o waiting for the watcher
+			publishState(context.Background())
+		}
+	}
+
+	return err
+}
+
+func (s *subscription) canCreateUser(currentTotal uint) error {
 	s.Lock()
 	defer s.Unlock()
 
@@ -172,7 +298,40 @@ func (s *subscription) CanCreateUser(currentTotal uint) error {
 // CanRegister - Can users (self) register (same rules as CanCreateUser but different error)
 //
 // We'll be showing this to everyone, so let's be careful not to tell too much
+//
+// With organisation subscriptions enabled, seats are checked same as in CanCreateUser
 func (s *subscription) CanRegister(currentTotal uint) error {
+	if t := s.seatSubscription(); t != nil {
+		return t.checkRegistration(context.Background())
+	}
+
+	return s.checkRegister(context.Background(), s.seatsUsedOr(currentTotal))
+}
+
+// Checks if there is a free seat for a user that signs up
+//
+// Unlike CanRegister, it fails when seats can not be counted
+func (s *subscription) checkRegistration(ctx context.Context) error {
+	used, err := s.seatsUsed(ctx)
+	if err != nil {
+		logger.Error("could not count subscription seats", zap.Error(err))
+		return ErrSeatCountFailed
+	}
+
+	return s.checkRegister(ctx, used)
+}
+
+func (s *subscription) checkRegister(ctx context.Context, used uint) error {
+	err := s.canRegister(used)
+	if err != nil {
+		userCreationBlockedCounter.WithLabelValues(ErrCodeSignupDisabled).Inc()
+		auditLimited(ctx, AuditRegistrationBlocked, s.claims(), err.Error())
+	}
+
+	return err
+}
+
+func (s *subscription) canRegister(currentTotal uint) error {
 	s.Lock()
 	defer s.Unlock()
 
@@ -183,15 +342,215 @@ func (s *subscription) CanRegister(currentTotal uint) error {
 	return s.error(signupError)
 }
 
-// Converts error template into error using subscription values
-func (s subscription) error(t string) error {
-	t = strings.NewReplacer(
-		"[exp-date]", s.expires.Format(time.RFC1123),
-		"[sales-email]", salesEmail,
-		"[user-limit]", strconv.Itoa(int(s.limitMaxUsers)),
-	).Replace(t)
+// IsEntitled - Does subscription include the given feature
+//
+// Subscriptions w/o any entitlements include all features
+func (s *subscription) IsEntitled(feature string) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.entitlements == nil || s.entitlements[feature] {
+		return nil
+	}
+
+	return s.error(notEntitledError, "[feature]", feature)
+}
+
+// CanUse - Does subscription allow adding to the current usage of a resource
+//
+// Resources w/o quota are not limited
+func (s *subscription) CanUse(resource string, current, adding uint64) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	var limit, has = s.quotas[resource]
+	if !has || current+adding <= limit {
+		return nil
+	}
+
+	var (
+		params = []string{
+			"[quota-limit]", strconv.FormatUint(limit, 10),
+			"[quota-resource]", resource,
+		}
+	)
+
+	if s.isTrial {
+		return s.error(trialQuotaError, params...)
+	}
+
+	return s.error(quotaError, params...)
+}
+
+// CanWrite - Does subscription allow changes or is it in read-only mode
+//
+// Subscription switches to read-only mode when grace period after expiration ends
+func (s *subscription) CanWrite() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.isReadOnly() {
+		return s.error(readOnlyError)
+	}
+
+	return nil
+}
+
+// CanStartSession - Does subscription allow another concurrent session
+//
+// Given number of active sessions is compared with the session limit
+func (s *subscription) CanStartSession(active uint) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.limitMaxSessions == 0 || active < s.limitMaxSessions {
+		return nil
+	}
+
+	return s.error(sessionLimitError, "[session-limit]", strconv.Itoa(int(s.limitMaxSessions)))
+}
+
+// Error for requests made with evicted sessions
+func (s *subscription) sessionEvicted() *Error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.error(sessionEvictedError)
+}
+
+// Is subscription expired for longer than the grace period
+func (s *subscription) isReadOnly() bool {
+	return s.isValid && now().After(s.expires.AddDate(0, 0, int(s.graceDays)))
+}
+
+// Returns claims that current subscription was updated with
+func (s *subscription) claims() *Claims {
+	s.RLock()
+	defer s.RUnlock()
+
+	if !s.isValid {
+		return nil
+	}
+
+	var (
+		graceDays = s.graceDays
+
+		c = &Claims{
+			ID:          s.id,
+			Domains:     s.domains,
+			Trial:       s.isTrial,
+			MaxUsers:    s.limitMaxUsers,
+			Expires:     s.expires,
+			SeatPolicy:  s.seatPolicy,
+			MaxSessions: s.limitMaxSessions,
+			Quotas:      s.quotas,
+			GraceDays:   &graceDays,
+			Branding:    s.branding,
+		}
+	)
+
+	for e := range s.entitlements {
+		c.Entitlements = append(c.Entitlements, e)
+	}
+
+	sort.Strings(c.Entitlements)
+	return c
+}
+
+// Counts seats under subscription's seat policy
+//
+// Organisation subscription counts only users of its organisation
+func (s *subscription) seatsUsed(ctx context.Context) (uint, error) {
+	s.RLock()
+	var policy = s.seatPolicy
+	s.RUnlock()
+
+	return countSeats(ctx, s.organisationID, policy)
+}
+
+// Counts seats for corteza's checks, falls back to corteza's
+// count of all users when seats can not be counted
+func (s *subscription) seatsUsedOr(total uint) uint {
+	used, err := s.seatsUsed(context.Background())
+	if err != nil {
+		logger.Warn("could not count subscription seats, using total number of users", zap.Error(err))
+		return total
+	}
+
+	return used
+}
+
+// Returns organisation subscription that current subscription passes the check to;
+// nil when checking organisation subscription or when there is none
+//
+// Used by checks that corteza makes w/o request context
+func (s *subscription) tenant(t *subscription) *subscription {
+	if s.organisationID > 0 || t == nil || t == s {
+		return nil
+	}
+
+	return t
+}
+
+// Returns subscription that corteza's seat checks are made against when
+// organisation subscriptions are enabled: the one seat is reserved for or the
+// current one when seat is not reserved; nil when they are disabled
+func (s *subscription) seatSubscription() *subscription {
+	if !opt.Tenants || s.organisationID > 0 {
+		return nil
+	}
+
+	if t := reserved.get(); t != nil {
+		return t
+	}
+
+	return s
+}
+
+// Returns quota for the resource, 0 when there is none
+func (s *subscription) quota(resource string) uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.quotas[resource]
+}
+
+// Converts message into error using subscription values;
+// message is rendered in the default language, see Error.Localize
+//
+// Additional (message-specific) parameters can be passed with rr
+// as pairs of placeholders and values ("[feature]", "compose")
+func (s *subscription) error(m message, rr ...string) *Error {
+	var (
+		b = s.brand()
+
+		e = &Error{
+			Code:     m.code,
+			Severity: m.severity,
+			Audience: m.audience,
+			Params: map[string]string{
+				"exp-date":      s.expires.Format(time.RFC3339),
+				"contact-email": b.ContactEmail,
+				"user-limit":    strconv.Itoa(int(s.limitMaxUsers)),
+				"product-name":  b.ProductName,
+			},
+		}
+	)
+
+	if b.RenewalURL != "" {
+		e.Params["renewal-url"] = b.RenewalURL
+	}
+
+	// Message-specific parameters
+	for i := 0; i+1 < len(rr); i += 2 {
+		e.Params[strings.Trim(rr[i], "[]")] = rr[i+1]
+	}
+
+	e.Message = render(defaultLanguage, e.Code, e.Params)
+	return e
+}
 
-	return errors.New(t)
+// Returns branding from claims, completed with configured and default values
+func (s *subscription) brand() Branding {
+	return s.branding.merge(configured.get()).merge(defaultBranding)
 }
 
 var _ SubscriptionChecker = &subscription{}
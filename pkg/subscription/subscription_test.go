@@ -0,0 +1,106 @@
+package subscription
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sony/sonyflake"
+	"github.com/titpetric/factory"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// In-process replacement for database locks
+	testLocks struct {
+		sync.Mutex
+		held  map[string]bool
+		taken []string
+
+		// Returned instead of taking the lock
+		err error
+	}
+)
+
+var (
+	errTestDB = errors.New("database is not available")
+)
+
+func init() {
+	// Settings are read with super-user context
+	auth.SetupDefault("test", 60)
+
+	// Audit events get IDs even when there is no database to record them to
+	factory.Sonyflake = &factory.SonyflakeFactory{Sonyflake: sonyflake.NewSonyflake(sonyflake.Settings{
+		StartTime: time.Unix(1503550784, 0),
+		MachineID: func() (uint16, error) { return 1, nil },
+	})}
+}
+
+// Makes subscription with the given claims current, returns function that restores the previous one
+func useSubscription(c *Claims) (*subscription, func()) {
+	var (
+		prev = service.CurrentSubscription
+		s    = &subscription{}
+	)
+
+	if c != nil {
+		s.Update(c)
+	}
+
+	service.CurrentSubscription = s
+	return s, func() { service.CurrentSubscription = prev }
+}
+
+// Makes seat counting return the given number or error
+func useSeats(used uint, err error) func() {
+	var prev = countSeats
+
+	countSeats = func(context.Context, uint64, string) (uint, error) {
+		return used, err
+	}
+
+	return func() { countSeats = prev }
+}
+
+// Replaces database locks with in-process ones
+func useTestLocks() (*testLocks, func()) {
+	var (
+		prev = lockDB
+		tl   = &testLocks{held: map[string]bool{}}
+	)
+
+	lockDB = tl.lock
+	return tl, func() { lockDB = prev }
+}
+
+func (tl *testLocks) lock(_ context.Context, name string, _ time.Duration) (func(), error) {
+	tl.Lock()
+	defer tl.Unlock()
+
+	if tl.err != nil {
+		return nil, tl.err
+	}
+
+	if tl.held[name] {
+		return nil, errLockTimeout
+	}
+
+	tl.held[name] = true
+	tl.taken = append(tl.taken, name)
+
+	return func() {
+		tl.Lock()
+		defer tl.Unlock()
+		delete(tl.held, name)
+	}, nil
+}
+
+func (tl *testLocks) isHeld(name string) bool {
+	tl.Lock()
+	defer tl.Unlock()
+	return tl.held[name]
+}
@@ -0,0 +1,58 @@
+package subscription
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+)
+
+var (
+	// Tables crust creates on its own; crust does not have its own migrations
+	tablesDDL = []string{
+		auditTableDDL,
+		sessionsTableDDL,
+		namespacesTableDDL,
+	}
+
+	tablesCreated bool
+	tablesLock    sync.Mutex
+)
+
+// Creates subscription tables when they do not exist yet
+//
+// Called by Load and, until it succeeds, by the watcher;
+// tables are never created while serving requests
+func createTables(ctx context.Context) error {
+	tablesLock.Lock()
+	defer tablesLock.Unlock()
+
+	if tablesCreated {
+		return nil
+	}
+
+	db, err := systemDB(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ddl := range tablesDDL {
+		if _, err = db.Exec(ddl); err != nil {
+			return errors.Wrap(err, "could not create subscription tables")
+		}
+	}
+
+	tablesCreated = true
+	return nil
+}
+
+// Returns system database
+func systemDB(ctx context.Context) (*factory.DB, error) {
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return nil, err
+	}
+
+	return db.With(ctx), nil
+}
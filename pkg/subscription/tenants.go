@@ -0,0 +1,394 @@
+package subscription
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/titpetric/factory"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// Subscriptions of organisations (tenants) with their own subscription key
+	//
+	// Requests are evaluated against the subscription of the organisation
+	// they belong to (see resolve); organisations w/o their own key and
+	// requests that can not be resolved use the current subscription
+	tenantRegistry struct {
+		sync.RWMutex
+
+		// Serializes loads (see loadTenants) and invalidations
+		loading sync.Mutex
+
+		// Subscriptions by organisation ID
+		tenants map[uint64]*subscription
+
+		// Loaded keys by organisation ID, kept for change detection
+		keys map[uint64]string
+
+		// Organisations of recently seen users
+		users map[uint64]userOrganisation
+	}
+
+	userOrganisation struct {
+		organisationID uint64
+		loaded         time.Time
+	}
+
+	tenantCtxKey struct{}
+)
+
+const (
+	// Organisation keys are stored under crust-subscription.organisation.<organisationID>.jwt
+	settingOrganisationKeyPrefix = "crust-subscription.organisation"
+	settingOrganisationKeySuffix = ".jwt"
+
+	// How long do we cache user's organisation
+	userOrganisationTTL = time.Minute
+)
+
+var (
+	tenants = &tenantRegistry{
+		tenants: map[uint64]*subscription{},
+		keys:    map[uint64]string{},
+		users:   map[uint64]userOrganisation{},
+	}
+)
+
+// Returns name of the setting with organisation's subscription key
+func organisationKeySetting(organisationID uint64) string {
+	return settingOrganisationKeyPrefix + "." + strconv.FormatUint(organisationID, 10) + settingOrganisationKeySuffix
+}
+
+// Loads subscription keys of all organisations, unchanged keys are not parsed again
+//
+// Organisation with invalid key gets invalid subscription; it does not fall back
+// to the current subscription
+func loadTenants(ctx context.Context) error {
+	if !opt.Tenants || settingsSvc == nil {
+		return nil
+	}
+
+	ctx = auth.SetSuperUserContext(ctx)
+
+	keys, err := organisationKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	tenants.loading.Lock()
+	defer tenants.loading.Unlock()
+
+	// Keys are parsed w/o holding the registry lock,
+	// loaded subscriptions replace the current ones at once
+	tenants.RLock()
+	var (
+		loadedKeys    = tenants.keys
+		loadedTenants = tenants.tenants
+
+		nextKeys    = make(map[uint64]string, len(keys))
+		nextTenants = make(map[uint64]*subscription, len(keys))
+	)
+	tenants.RUnlock()
+
+	for id, key := range keys {
+		prev, loaded := loadedKeys[id]
+		if loaded && prev == key {
+			nextKeys[id] = key
+			nextTenants[id] = loadedTenants[id]
+			continue
+		}
+
+		var (
+			log = logger.With(zap.Uint64("organisationID", id))
+			t   = &subscription{organisationID: id}
+		)
+
+		claims, err := parseInstalled(ctx, key)
+		if isTransient(err) {
+			// Key is checked again on next load; until then, organisation
+			// keeps its subscription or gets an invalid one
+			log.Warn("could not check organisation subscription", zap.Error(err))
+			if loaded {
+				nextKeys[id] = prev
+			}
+
+			if prevTenant, ok := loadedTenants[id]; ok {
+				t = prevTenant
+			}
+
+			nextTenants[id] = t
+			continue
+		}
+
+		nextKeys[id] = key
+		nextTenants[id] = t
+
+		if err != nil {
+			log.Warn("invalid organisation subscription", zap.Error(err))
+			continue
+		}
+
+		t.Update(claims)
+		if loaded {
+			audit(ctx, AuditKeyChanged, claims, "subscription key of organisation "+strconv.FormatUint(id, 10)+" changed")
+		}
+
+		log.Info("organisation subscription updated",
+			zap.Strings("domains", claims.Domains),
+			zap.Time("expires", claims.Expires),
+			zap.Uint("limit-max-users", claims.MaxUsers))
+	}
+
+	for id := range loadedTenants {
+		if _, ok := keys[id]; !ok {
+			logger.Info("organisation subscription removed", zap.Uint64("organisationID", id))
+		}
+	}
+
+	tenants.Lock()
+	tenants.keys = nextKeys
+	tenants.tenants = nextTenants
+	tenants.Unlock()
+
+	return nil
+}
+
+// Returns subscription keys of organisations by organisation ID
+func organisationKeys(ctx context.Context) (map[uint64]string, error) {
+	vv, err := settingsSvc.FindByPrefix(auth.SetSuperUserContext(ctx), settingOrganisationKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys = map[uint64]string{}
+	for _, v := range vv {
+		var name = strings.TrimPrefix(v.Name, settingOrganisationKeyPrefix+".")
+		if v.OwnedBy != 0 || !strings.HasSuffix(name, settingOrganisationKeySuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, settingOrganisationKeySuffix), 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+
+		if key := v.String(); key != "" {
+			keys[id] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// Forces re-parsing of all organisation keys on the next load
+func (tr *tenantRegistry) invalidate() {
+	tr.loading.Lock()
+	defer tr.loading.Unlock()
+
+	tr.Lock()
+	defer tr.Unlock()
+	tr.keys = map[uint64]string{}
+}
+
+// Returns subscription of the organisation, nil when organisation has no subscription key
+func (tr *tenantRegistry) get(organisationID uint64) *subscription {
+	tr.RLock()
+	defer tr.RUnlock()
+	return tr.tenants[organisationID]
+}
+
+// Returns subscription of the organisation with a domain pattern that matches the domain
+//
+// When domain matches patterns of more organisations, exact domain takes
+// precedence over wildcards and wildcards of longer domains over shorter ones;
+// organisation with the lowest ID is used when patterns match equally
+func (tr *tenantRegistry) byDomain(domain string) *subscription {
+	tr.RLock()
+	defer tr.RUnlock()
+
+	var (
+		best      *subscription
+		bestMatch = -1
+	)
+
+	for id, t := range tr.tenants {
+		t.RLock()
+		var match = t.domainMatch(domain)
+		t.RUnlock()
+
+		if match > bestMatch || match == bestMatch && match >= 0 && id < best.organisationID {
+			best, bestMatch = t, match
+		}
+	}
+
+	return best
+}
+
+// Resolves organisation subscription for the request
+//
+// Organisation of authenticated user (user's organisation membership) takes
+// precedence over the one resolved from the request domain
+func (tr *tenantRegistry) resolve(r *http.Request) *subscription {
+	if !opt.Tenants {
+		return nil
+	}
+
+	if userID := auth.GetIdentityFromContext(r.Context()).Identity(); userID > 0 {
+		if t := tr.get(tr.userOrganisation(r.Context(), userID)); t != nil {
+			return t
+		}
+	}
+
+	return tr.byDomain(requestDomain(r))
+}
+
+// Returns ID of the organisation user belongs to, 0 when none
+func (tr *tenantRegistry) userOrganisation(ctx context.Context, userID uint64) uint64 {
+	tr.RLock()
+	var cached, ok = tr.users[userID]
+	tr.RUnlock()
+
+	if ok && now().Sub(cached.loaded) < userOrganisationTTL {
+		return cached.organisationID
+	}
+
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		logger.Warn("could not resolve user's organisation", zap.Error(err))
+		return 0
+	}
+
+	var (
+		aux = struct {
+			OrganisationID uint64 `db:"rel_organisation"`
+		}{}
+
+		q = squirrel.
+			Select("rel_organisation").
+			From("sys_user").
+			Where("id = ?", userID)
+	)
+
+	if err = rh.FetchOne(db.With(ctx), q, &aux); err != nil {
+		logger.Warn("could not resolve user's organisation", zap.Uint64("userID", userID), zap.Error(err))
+		return 0
+	}
+
+	tr.Lock()
+	defer tr.Unlock()
+
+	for id, u := range tr.users {
+		// Forget stale entries
+		if now().Sub(u.loaded) >= userOrganisationTTL {
+			delete(tr.users, id)
+		}
+	}
+
+	tr.users[userID] = userOrganisation{organisationID: aux.OrganisationID, loaded: now()}
+	return aux.OrganisationID
+}
+
+// Returns all organisation subscriptions
+func (tr *tenantRegistry) all() map[uint64]*subscription {
+	tr.RLock()
+	defer tr.RUnlock()
+
+	var out = make(map[uint64]*subscription, len(tr.tenants))
+	for id, t := range tr.tenants {
+		out[id] = t
+	}
+
+	return out
+}
+
+// Middleware that resolves organisation subscription for the request
+//
+// GuardRoutes adds it in front of all other middlewares
+func resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := tenants.resolve(r); t != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tenantCtxKey{}, t))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns subscription the request is evaluated against:
+// organisation subscription when resolved, current subscription otherwise
+func subscriptionFor(ctx context.Context) *subscription {
+	if t, ok := ctx.Value(tenantCtxKey{}).(*subscription); ok {
+		return t
+	}
+
+	s, _ := service.CurrentSubscription.(*subscription)
+	return s
+}
+
+// Returns ID of the organisation the request is evaluated for, 0 for the installation
+func organisationOf(ctx context.Context) uint64 {
+	if t, ok := ctx.Value(tenantCtxKey{}).(*subscription); ok {
+		return t.organisationID
+	}
+
+	return 0
+}
+
+// Assigns user to the organisation, unless user already belongs to one
+func assignOrganisation(ctx context.Context, userID, organisationID uint64) error {
+	if organisationID == 0 {
+		return nil
+	}
+
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.With(ctx).Exec(
+		"UPDATE sys_user SET rel_organisation = ? WHERE id = ? AND rel_organisation = 0",
+		organisationID,
+		userID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	tenants.Lock()
+	delete(tenants.users, userID)
+	tenants.Unlock()
+
+	return nil
+}
+
+// Returns filter for users that take seats of the organisation subscription
+//
+// Users of organisations w/o their own subscription key take seats of the
+// current subscription. Nil is returned when organisation subscriptions are disabled.
+func organisationSeats(organisationID uint64) squirrel.Sqlizer {
+	if !opt.Tenants {
+		return nil
+	}
+
+	if organisationID > 0 {
+		return squirrel.Eq{"rel_organisation": organisationID}
+	}
+
+	var ids = []uint64{}
+	for id := range tenants.all() {
+		ids = append(ids, id)
+	}
+
+	return squirrel.NotEq{"rel_organisation": ids}
+}
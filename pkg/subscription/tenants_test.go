@@ -0,0 +1,177 @@
+package subscription
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Replaces organisation subscriptions, returns function that restores them
+func useTenants(tt map[uint64]*subscription) func() {
+	var prev = tenants
+
+	tenants = &tenantRegistry{
+		tenants: map[uint64]*subscription{},
+		keys:    map[uint64]string{},
+		users:   map[uint64]userOrganisation{},
+	}
+
+	for id, t := range tt {
+		t.organisationID = id
+		tenants.tenants[id] = t
+	}
+
+	return func() { tenants = prev }
+}
+
+func TestTenantByDomain(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	tenant := func(domains ...string) *subscription {
+		var s = &subscription{}
+		s.Update(&Claims{Domains: domains, Expires: at.AddDate(1, 0, 0)})
+		return s
+	}
+
+	defer useTenants(map[uint64]*subscription{
+		1: tenant("*"),
+		2: tenant("*.example.com"),
+		3: tenant(".example.com"),
+		4: tenant("*.eu.example.com"),
+		5: tenant("eu.example.com"),
+		6: tenant("shop.example.com", "shop.example.org"),
+		7: tenant("shop.example.org"),
+		8: tenant(),
+	})()
+
+	tests := []struct {
+		domain string
+		want   uint64
+	}{
+		{"eu.example.com", 5},
+		{"crm.eu.example.com", 4},
+		{"crm.example.com", 2},
+		{"example.com", 3},
+		{"shop.example.com", 6},
+		{"shop.example.org", 6},
+		{"SHOP.example.org.", 6},
+		{"example.net", 1},
+	}
+
+	for _, tt := range tests {
+		// Map iteration order differs between runs
+		for i := 0; i < 10; i++ {
+			var got uint64
+			if s := tenants.byDomain(tt.domain); s != nil {
+				got = s.organisationID
+			}
+
+			if got != tt.want {
+				t.Errorf("byDomain(%q) = %d, want %d", tt.domain, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTenantByDomainNoMatch(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	var s = &subscription{}
+	s.Update(&Claims{Domains: []string{"example.com"}, Expires: at.AddDate(1, 0, 0)})
+
+	defer useTenants(map[uint64]*subscription{1: s, 2: {}})()
+
+	if got := tenants.byDomain("example.org"); got != nil {
+		t.Errorf("byDomain() = organisation %d, want none", got.organisationID)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+	opt.Tenants = true
+
+	key := func(c Claims) string {
+		c.Expires = at.AddDate(1, 0, 0)
+		return testSign(c, HEADER_TYPE)
+	}
+
+	var (
+		key1 = key(Claims{MaxUsers: 1})
+		key2 = key(Claims{MaxUsers: 2})
+
+		// Installation can not be checked w/o database
+		transient = key(Claims{MaxUsers: 3, Installations: []string{"installation"}})
+	)
+
+	ts, restore := useTestSettings(nil)
+	defer restore()
+	defer useTenants(nil)()
+
+	set := func(id uint64, key string) {
+		if key == "" {
+			delete(ts.vv, organisationKeySetting(id))
+		} else {
+			ts.vv[organisationKeySetting(id)] = key
+		}
+	}
+
+	tests := []struct {
+		name string
+		keys map[uint64]string
+
+		// Expected seat limits by organisation, 0 for invalid subscription
+		want map[uint64]uint
+
+		// Organisations that keep their subscription
+		kept []uint64
+	}{
+		{"initial", map[uint64]string{1: key1, 2: "invalid", 3: transient}, map[uint64]uint{1: 1, 2: 0, 3: 0}, nil},
+		{"unchanged", map[uint64]string{1: key1, 2: "invalid", 3: transient}, map[uint64]uint{1: 1, 2: 0, 3: 0}, []uint64{1, 2}},
+		{"changed", map[uint64]string{1: key2, 2: key1, 3: key2}, map[uint64]uint{1: 2, 2: 1, 3: 2}, nil},
+		{"transient failure keeps subscription", map[uint64]string{1: transient, 2: key1, 3: key2}, map[uint64]uint{1: 2, 2: 1, 3: 2}, []uint64{1, 2, 3}},
+		{"removed", map[uint64]string{3: key2}, map[uint64]uint{3: 2}, []uint64{3}},
+	}
+
+	for _, tt := range tests {
+		var prev = tenants.all()
+
+		for id := range prev {
+			set(id, "")
+		}
+
+		for id, key := range tt.keys {
+			set(id, key)
+		}
+
+		if err := loadTenants(context.Background()); err != nil {
+			t.Fatalf("%s: loadTenants() = %v", tt.name, err)
+		}
+
+		var loaded = tenants.all()
+		if len(loaded) != len(tt.want) {
+			t.Errorf("%s: loaded %d organisation subscriptions, want %d", tt.name, len(loaded), len(tt.want))
+		}
+
+		for id, limit := range tt.want {
+			s := tenants.get(id)
+			if s == nil {
+				t.Errorf("%s: organisation %d has no subscription", tt.name, id)
+				continue
+			}
+
+			if s.organisationID != id || s.limitMaxUsers != limit || s.isValid != (limit > 0) {
+				t.Errorf("%s: organisation %d subscription (valid: %v, max users: %d), want max users: %d", tt.name, id, s.isValid, s.limitMaxUsers, limit)
+			}
+		}
+
+		for _, id := range tt.kept {
+			if tenants.get(id) != prev[id] {
+				t.Errorf("%s: organisation %d subscription replaced", tt.name, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package subscription
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+	"github.com/titpetric/factory"
+
+	"github.com/cortezaproject/corteza-server/pkg/rh"
+)
+
+type (
+	// Generic trial as stored in the settings
+	//
+	// Record is MACed and bound to the installation ID so that it can not be
+	// simply edited, copied from another installation or replaced with a plain
+	// date. This is obfuscation, not tamper resistance: MAC secret is compiled
+	// into the binary (see trialSecret) and anyone with database access who
+	// extracts it can forge a record.
+	trialRecord struct {
+		InstallationID string    `json:"iid"`
+		Issued         time.Time `json:"iat"`
+		Expires        time.Time `json:"exp"`
+	}
+)
+
+const (
+	// Length of the generic trial
+	trialDays = 31
+
+	// Tolerated difference between trial issue time and current time;
+	// anything more means that the clock was turned back
+	trialClockSkew = 24 * time.Hour
+
+	// Format of the trial record used by older versions
+	legacyTrialFormat = "2006-01-02"
+)
+
+var (
+	// Secret for trial record MAC
+	//
+	// Default value is public; release builds set their own
+	// (TRIAL_SECRET in scripts/builder-make-bin.sh):
+	//   -ldflags "-X github.com/crusttech/crust-server/pkg/subscription.trialSecret=..."
+	//
+	// Changing it invalidates all existing trial records.
+	trialSecret = "crust-subscription.trial.v1"
+
+	errTrialTampered = errors.New("generic trial has been tampered with")
+
+	firstActivityQuery = squirrel.
+				Select("MIN(created_at) AS first_activity").
+				From("sys_user")
+)
+
+// Encodes trial record and its MAC
+func (t trialRecord) encode() (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(trialMAC(t.InstallationID, payload)), nil
+}
+
+// Valid verifies record against installation and the current time
+func (t trialRecord) Valid(installationID string) error {
+	switch {
+	case t.InstallationID != installationID:
+		return errors.Wrap(errTrialTampered, "installation ID mismatch")
+
+	case t.Expires.After(t.Issued.AddDate(0, 0, trialDays)):
+		return errors.Wrap(errTrialTampered, "trial longer than allowed")
+
+	case t.Issued.After(now().Add(trialClockSkew)):
+		return errors.Wrap(errTrialTampered, "trial issued in the future, clock turned back")
+	}
+
+	return nil
+}
+
+// Decodes trial record and verifies its MAC
+func decodeTrialRecord(installationID, enc string) (*trialRecord, error) {
+	var (
+		t     = &trialRecord{}
+		parts = strings.Split(enc, ".")
+	)
+
+	if len(parts) != 2 {
+		return nil, errors.Wrap(errTrialTampered, "malformed record")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(errTrialTampered, "malformed record")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, trialMAC(installationID, payload)) {
+		return nil, errors.Wrap(errTrialTampered, "invalid signature")
+	}
+
+	if err = json.Unmarshal(payload, t); err != nil {
+		return nil, errors.Wrap(errTrialTampered, "malformed record")
+	}
+
+	return t, t.Valid(installationID)
+}
+
+// MAC of the trial record payload, keyed with secret and installation ID
+func trialMAC(installationID string, payload []byte) []byte {
+	key := sha256.Sum256([]byte(trialSecret + "." + installationID))
+	m := hmac.New(sha256.New, key[:])
+	_, _ = m.Write(payload)
+	return m.Sum(nil)
+}
+
+// Returns claims of the generic trial
+func (t trialRecord) claims() *Claims {
+	return &Claims{Trial: true, MaxUsers: 10, Expires: t.Expires}
+}
+
+// Returns new trial record, issued at the given time
+func newTrialRecord(installationID string, issued time.Time) *trialRecord {
+	issued = time.Date(issued.Year(), issued.Month(), issued.Day(), 0, 0, 0, 0, issued.Location())
+
+	return &trialRecord{
+		InstallationID: installationID,
+		Issued:         issued,
+		Expires:        issued.AddDate(0, 0, trialDays),
+	}
+}
+
+// Returns trial record that expired today; used when trial was tampered with
+func expiredTrialRecord(installationID string) *trialRecord {
+	t := newTrialRecord(installationID, now())
+	t.Issued = t.Issued.AddDate(0, 0, -trialDays)
+	t.Expires = t.Issued.AddDate(0, 0, trialDays)
+	return t
+}
+
+// Returns time of the first activity on this installation (first user created)
+//
+// New trials are dated back to it so that removing the trial record
+// does not give the installation a fresh trial. Zero time is returned
+// when there is no activity yet
+func firstActivity(ctx context.Context) (time.Time, error) {
+	db, err := factory.Database.Get("system")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var aux = struct {
+		FirstActivity *time.Time `db:"first_activity"`
+	}{}
+
+	if err = rh.FetchOne(db.With(ctx), firstActivityQuery, &aux); err != nil {
+		return time.Time{}, err
+	}
+
+	if aux.FirstActivity == nil {
+		return time.Time{}, nil
+	}
+
+	return *aux.FirstActivity, nil
+}
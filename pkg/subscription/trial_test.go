@@ -0,0 +1,170 @@
+package subscription
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTrialRecordValid(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	tests := []struct {
+		name   string
+		record trialRecord
+		valid  bool
+	}{
+		{"new", *newTrialRecord("iid", at), true},
+		{"expired", *newTrialRecord("iid", at.AddDate(0, -2, 0)), true},
+		{"issued within skew", *newTrialRecord("iid", at.Add(trialClockSkew/2)), true},
+		{"other installation", *newTrialRecord("other", at), false},
+		{"extended", trialRecord{InstallationID: "iid", Issued: at, Expires: at.AddDate(0, 0, trialDays+1)}, false},
+		{"issued in future", *newTrialRecord("iid", at.AddDate(0, 0, 2)), false},
+	}
+
+	for _, tt := range tests {
+		err := tt.record.Valid("iid")
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: Valid() = %v, want valid: %v", tt.name, err, tt.valid)
+		}
+
+		if err != nil && errors.Cause(err) != errTrialTampered {
+			t.Errorf("%s: Valid() = %v, want errTrialTampered", tt.name, err)
+		}
+	}
+}
+
+func TestDecodeTrialRecord(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	var issued = newTrialRecord("iid", at)
+
+	enc, err := issued.encode()
+	if err != nil {
+		t.Fatalf("encode() = %v", err)
+	}
+
+	var (
+		parts   = strings.Split(enc, ".")
+		payload = func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	)
+
+	tests := []struct {
+		name           string
+		installationID string
+		enc            string
+		valid          bool
+	}{
+		{"valid", "iid", enc, true},
+		{"other installation", "other", enc, false},
+		{"legacy date", "iid", "2019-06-01", false},
+		{"empty", "iid", "", false},
+		{"too many parts", "iid", enc + ".x", false},
+		{"malformed payload", "iid", "!!!." + parts[1], false},
+		{"malformed signature", "iid", parts[0] + ".!!!", false},
+		{"edited payload", "iid", payload(`{"iid":"iid","iat":"2019-06-01T00:00:00Z","exp":"2029-06-01T00:00:00Z"}`) + "." + parts[1], false},
+		{"missing signature", "iid", parts[0] + ".", false},
+	}
+
+	for _, tt := range tests {
+		r, err := decodeTrialRecord(tt.installationID, tt.enc)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: decodeTrialRecord() = %v, want valid: %v", tt.name, err, tt.valid)
+			continue
+		}
+
+		if err != nil {
+			if errors.Cause(err) != errTrialTampered {
+				t.Errorf("%s: decodeTrialRecord() = %v, want errTrialTampered", tt.name, err)
+			}
+
+			continue
+		}
+
+		if !r.Expires.Equal(issued.Expires) {
+			t.Errorf("%s: Expires = %v, want %v", tt.name, r.Expires, issued.Expires)
+		}
+	}
+}
+
+func TestIssueTrial(t *testing.T) {
+	var (
+		at  = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+		iid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+
+		today   = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+		legacy  = today.AddDate(0, 0, 10)
+		expired = today
+	)
+
+	defer fixClock(at)()
+
+	record := func(installationID string, issued time.Time) string {
+		enc, err := newTrialRecord(installationID, issued).encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return enc
+	}
+
+	tests := []struct {
+		name string
+
+		// Stored installation ID, trial and installation the trial was first recorded for
+		installed string
+		trial     string
+		recorded  string
+
+		expires time.Time
+	}{
+		{name: "new installation", expires: today.AddDate(0, 0, trialDays)},
+		{name: "valid record", installed: iid, trial: record(iid, today.AddDate(0, 0, -5)), recorded: iid, expires: today.AddDate(0, 0, trialDays-5)},
+		{name: "legacy date", trial: legacy.Format(legacyTrialFormat), expires: legacy},
+		{name: "legacy date, installation ID exists", installed: iid, trial: legacy.Format(legacyTrialFormat), expires: legacy},
+		{name: "legacy date, after record", installed: iid, trial: legacy.Format(legacyTrialFormat), recorded: iid, expires: expired},
+		{name: "other installation's record", installed: iid, trial: record("other", today), recorded: iid, expires: expired},
+		{name: "removed record", installed: iid, recorded: iid, expires: expired},
+	}
+
+	for _, tt := range tests {
+		ts, restore := useTestSettings(nil)
+
+		for name, v := range map[string]string{
+			settingInstallationID:               tt.installed,
+			settingSubscriptionTrialKey:         tt.trial,
+			settingSubscriptionTrialRecordedKey: tt.recorded,
+		} {
+			if v != "" {
+				ts.vv[name] = v
+			}
+		}
+
+		c := issueTrial(context.Background())
+		if c == nil {
+			t.Fatalf("%s: issueTrial() issued no trial", tt.name)
+		}
+
+		if !c.Expires.Equal(tt.expires) {
+			t.Errorf("%s: trial expires %v, want %v", tt.name, c.Expires, tt.expires)
+		}
+
+		// Trial is stored as record bound to this installation
+		var installed = ts.vv[settingInstallationID]
+		if r, err := decodeTrialRecord(installed, ts.vv[settingSubscriptionTrialKey]); err != nil || !r.Expires.Equal(tt.expires) {
+			t.Errorf("%s: stored trial %q (%v), want record that expires %v", tt.name, ts.vv[settingSubscriptionTrialKey], err, tt.expires)
+		}
+
+		if ts.vv[settingSubscriptionTrialRecordedKey] == "" {
+			t.Errorf("%s: trial record not marked as recorded", tt.name)
+		}
+
+		restore()
+	}
+}
@@ -0,0 +1,401 @@
+package subscription
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/auth"
+	"github.com/cortezaproject/corteza-server/pkg/sentry"
+	"github.com/cortezaproject/corteza-server/pkg/settings"
+	"github.com/cortezaproject/corteza-server/system/service"
+)
+
+type (
+	// UsageReport holds usage of this installation, used for license true-ups
+	UsageReport struct {
+		GeneratedAt    time.Time `json:"generatedAt"`
+		InstallationID string    `json:"installationID"`
+
+		// Reported subscription
+		SubscriptionID string   `json:"subscriptionID,omitempty"`
+		Trial          bool     `json:"trial"`
+		Domains        []string `json:"domains"`
+		SeatsLimit     uint     `json:"seatsLimit"`
+		SeatPolicy     string   `json:"seatPolicy"`
+
+		// Start of the period that peak values were collected in
+		PeriodStart time.Time `json:"periodStart"`
+
+		// Highest number of active users in this period
+		PeakActiveUsers uint `json:"peakActiveUsers"`
+
+		Seats *SeatMetrics `json:"seats"`
+
+		// System statistics (users, roles, applications)
+		Metrics interface{} `json:"metrics"`
+
+		// Current usage of resources (see Quota* constants);
+		// resources that could not be counted are omitted
+		Resources map[string]uint64 `json:"resources"`
+	}
+
+	// SignedUsageReport wraps usage report with signature and
+	// installation's public key
+	//
+	// Signature is ES256 over (compacted) report JSON; see Verify
+	// for what it does (and does not) prove
+	SignedUsageReport struct {
+		Report    json.RawMessage `json:"report"`
+		Algorithm string          `json:"algorithm"`
+		PublicKey string          `json:"publicKey"`
+		Signature string          `json:"signature"`
+	}
+
+	// Highest number of active users since the start of the period
+	usagePeak struct {
+		Active uint      `json:"active"`
+		Since  time.Time `json:"since"`
+	}
+)
+
+const (
+	settingUsagePeakKey = "crust-subscription.usage.peak"
+
+	// When was the last usage report written (by any of the replicas)
+	settingUsageReportedKey = "crust-subscription.usage.reported"
+
+	// Name of the database lock that serializes usage peak updates and reports
+	usageLockName = "crust-subscription.usage"
+)
+
+var (
+	usageSigningMethod = jwt.SigningMethodES256
+)
+
+// CollectUsage collects current usage and updates the peak
+//
+// When newPeriod is set, peak values are reset after they are reported.
+// Peak is updated while holding a database lock, shared by all replicas.
+func CollectUsage(ctx context.Context, newPeriod bool) (*UsageReport, error) {
+	release, err := lockUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	return collectUsage(ctx, newPeriod)
+}
+
+// Collects usage, expects caller to hold the usage lock
+func collectUsage(ctx context.Context, newPeriod bool) (*UsageReport, error) {
+	var (
+		r = &UsageReport{
+			GeneratedAt: now(),
+			Domains:     []string{},
+			Resources:   make(map[string]uint64),
+		}
+
+		err error
+	)
+
+	ctx = auth.SetSuperUserContext(ctx)
+
+	if r.InstallationID, err = InstallationID(ctx); err != nil {
+		return nil, err
+	}
+
+	if r.Metrics, err = service.Statistics(ctx).Metrics(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not collect statistics")
+	}
+
+	if r.Seats, err = seatMetrics(ctx, nil); err != nil {
+		return nil, errors.Wrap(err, "could not count seats")
+	}
+
+	for resource := range usageCounters {
+		if count, err := Usage(ctx, resource); err != nil {
+			logger.Debug("could not count resource usage", zap.String("resource", resource), zap.Error(err))
+		} else {
+			r.Resources[resource] = count
+		}
+	}
+
+	if s, ok := service.CurrentSubscription.(*subscription); ok {
+		s.RLock()
+		r.SubscriptionID = s.id
+		r.Trial = s.isTrial
+		r.Domains = append(r.Domains, s.domains...)
+		r.SeatsLimit = s.limitMaxUsers
+		r.SeatPolicy = s.seatPolicy
+		s.RUnlock()
+	}
+
+	peak, err := updateUsagePeak(ctx, r.Seats.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	r.PeriodStart = peak.Since
+	r.PeakActiveUsers = peak.Active
+
+	if newPeriod {
+		if err = saveUsagePeak(ctx, &usagePeak{Active: r.Seats.Active, Since: r.GeneratedAt}); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Takes database lock that serializes usage peak updates and reports
+func lockUsage(ctx context.Context) (func(), error) {
+	release, err := lockDB(ctx, usageLockName, opt.LockTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not lock usage")
+	}
+
+	return release, nil
+}
+
+// Raises stored peak of active users if needed and returns it
+//
+// Expects caller to hold the usage lock
+func updateUsagePeak(ctx context.Context, active uint) (*usagePeak, error) {
+	var peak = &usagePeak{}
+
+	if settingsSvc == nil {
+		return nil, errors.New("no settings service")
+	}
+
+	v, err := settingsSvc.Get(ctx, settingUsagePeakKey, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load usage peak")
+	}
+
+	if v != nil {
+		if err = json.Unmarshal(v.Value, peak); err != nil {
+			logger.Warn("could not decode usage peak, starting new period", zap.Error(err))
+			peak = &usagePeak{}
+		}
+	}
+
+	if peak.Since.IsZero() {
+		peak.Since = now()
+	} else if peak.Active >= active {
+		return peak, nil
+	}
+
+	if peak.Active < active {
+		peak.Active = active
+	}
+
+	return peak, saveUsagePeak(ctx, peak)
+}
+
+func saveUsagePeak(ctx context.Context, peak *usagePeak) error {
+	v := &settings.Value{Name: settingUsagePeakKey}
+	_ = v.SetValue(peak)
+
+	return errors.Wrap(settingsSvc.Set(ctx, v), "could not save usage peak")
+}
+
+// SignUsageReport signs the report with installation's key
+func SignUsageReport(ctx context.Context, r *UsageReport) (*SignedUsageReport, error) {
+	key, err := installationKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return signUsageReport(r, key)
+}
+
+func signUsageReport(r *UsageReport, key *ecdsa.PrivateKey) (sr *SignedUsageReport, err error) {
+	sr = &SignedUsageReport{Algorithm: usageSigningMethod.Alg()}
+
+	if sr.Report, err = json.Marshal(r); err != nil {
+		return nil, err
+	}
+
+	if sr.PublicKey, err = encodePublicKey(&key.PublicKey); err != nil {
+		return nil, err
+	}
+
+	if sr.Signature, err = usageSigningMethod.Sign(string(sr.Report), key); err != nil {
+		return nil, errors.Wrap(err, "could not sign usage report")
+	}
+
+	return sr, nil
+}
+
+// Verify checks report's signature against its public key
+//
+// Report carries its own public key, anyone can create a report that verifies.
+// Successful verification alone proves nothing about report's origin; caller
+// must compare PublicKey with the public key recorded for the installation
+// (see InstallationPublicKey). Even then, report holds values as installation
+// sees them; usage peak is kept in a setting that administrators can edit.
+func (sr *SignedUsageReport) Verify() (*UsageReport, error) {
+	var (
+		r   = &UsageReport{}
+		buf = &bytes.Buffer{}
+	)
+
+	if sr.Algorithm != usageSigningMethod.Alg() {
+		return nil, errors.Errorf("unsupported usage report signing algorithm %q", sr.Algorithm)
+	}
+
+	key, err := jwt.ParseECPublicKeyFromPEM([]byte(sr.PublicKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid usage report public key")
+	}
+
+	// Report is signed in its compact form
+	if err = json.Compact(buf, sr.Report); err != nil {
+		return nil, err
+	}
+
+	if err = usageSigningMethod.Verify(buf.String(), sr.Signature, key); err != nil {
+		return nil, errors.Wrap(err, "invalid usage report signature")
+	}
+
+	return r, json.Unmarshal(buf.Bytes(), r)
+}
+
+// Samples usage; writes usage report instead when it is due
+//
+// Replicas sample usage independently; report is written by the first one
+// that samples usage after the report interval passed and starts a new period.
+//
+// Returns path of the written report, empty when report was not written
+func sampleUsage(ctx context.Context) (string, error) {
+	release, err := lockUsage(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	defer release()
+
+	if due, err := usageReportDue(ctx); err != nil {
+		return "", err
+	} else if !due {
+		_, err = collectUsage(ctx, false)
+		return "", err
+	}
+
+	r, err := collectUsage(ctx, true)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := writeUsageReport(ctx, opt.UsageReportDir, r)
+	if err != nil {
+		return "", err
+	}
+
+	v := &settings.Value{Name: settingUsageReportedKey}
+	_ = v.SetValue(r.GeneratedAt)
+
+	return path, errors.Wrap(settingsSvc.Set(ctx, v), "could not save usage report time")
+}
+
+// Checks if report interval passed since the last usage report
+//
+// Reports are never due when report directory or interval is not set
+func usageReportDue(ctx context.Context) (bool, error) {
+	if opt.UsageReportDir == "" || opt.UsageReportInterval <= 0 {
+		return false, nil
+	}
+
+	if settingsSvc == nil {
+		return false, errors.New("no settings service")
+	}
+
+	v, err := settingsSvc.Get(ctx, settingUsageReportedKey, 0)
+	if err != nil {
+		return false, errors.Wrap(err, "could not load usage report time")
+	}
+
+	var reported time.Time
+	if v != nil {
+		if err = json.Unmarshal(v.Value, &reported); err != nil {
+			logger.Warn("could not decode usage report time", zap.Error(err))
+		}
+	}
+
+	return reported.IsZero() || now().Sub(reported) >= opt.UsageReportInterval, nil
+}
+
+// Signs and writes usage report to the given directory
+//
+// Report file is named after the time it was generated
+func writeUsageReport(ctx context.Context, dir string, r *UsageReport) (string, error) {
+	sr, err := SignUsageReport(ctx, r)
+	if err != nil {
+		return "", err
+	}
+
+	buf, err := json.MarshalIndent(sr, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	var path = filepath.Join(dir, "usage-report-"+r.GeneratedAt.UTC().Format("20060102T150405Z")+".json")
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	return path, ioutil.WriteFile(path, buf, 0640)
+}
+
+// ReportUsage periodically samples usage (for peak values) and,
+// when report directory is configured, writes signed usage reports
+func ReportUsage(ctx context.Context) {
+	if opt.UsageSampleInterval <= 0 {
+		logger.Debug("usage reporting disabled")
+		return
+	}
+
+	go func() {
+		defer sentry.Recover()
+
+		var sampler = time.NewTicker(opt.UsageSampleInterval)
+		defer sampler.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-sampler.C:
+				if path, err := sampleUsage(ctx); err != nil {
+					logger.Warn("could not sample usage", zap.Error(err))
+				} else if path != "" {
+					logger.Info("usage report written", zap.String("path", path))
+				}
+			}
+		}
+	}()
+}
+
+// Returns sorted list of resources in the report
+func (r *UsageReport) resources() []string {
+	var rr = make([]string, 0, len(r.Resources))
+	for resource := range r.Resources {
+		rr = append(rr, resource)
+	}
+
+	sort.Strings(rr)
+	return rr
+}
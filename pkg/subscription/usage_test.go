@@ -0,0 +1,189 @@
+package subscription
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUsageReportSignature(t *testing.T) {
+	var (
+		at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		report = &UsageReport{
+			GeneratedAt:     at,
+			InstallationID:  "installation",
+			PeakActiveUsers: 7,
+			Seats:           &SeatMetrics{Total: 10, Active: 5},
+			Resources:       map[string]uint64{QuotaRecords: 42},
+		}
+
+		otherKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	)
+
+	sign := func() *SignedUsageReport {
+		sr, err := signUsageReport(report, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sr
+	}
+
+	tests := []struct {
+		name   string
+		change func(sr *SignedUsageReport)
+		valid  bool
+	}{
+		{"signed", func(*SignedUsageReport) {}, true},
+		{
+			"indented",
+			func(sr *SignedUsageReport) {
+				var buf = &bytes.Buffer{}
+				_ = json.Indent(buf, sr.Report, "", "  ")
+				sr.Report = buf.Bytes()
+			},
+			true,
+		},
+		{
+			"changed report",
+			func(sr *SignedUsageReport) {
+				sr.Report = bytes.Replace(sr.Report, []byte(`"peakActiveUsers":7`), []byte(`"peakActiveUsers":1`), 1)
+			},
+			false,
+		},
+		{
+			"other public key",
+			func(sr *SignedUsageReport) { sr.PublicKey = mustEncodePublicKey(&otherKey.PublicKey) },
+			false,
+		},
+		{"invalid public key", func(sr *SignedUsageReport) { sr.PublicKey = "not a key" }, false},
+		{"other algorithm", func(sr *SignedUsageReport) { sr.Algorithm = "HS256" }, false},
+		{"no signature", func(sr *SignedUsageReport) { sr.Signature = "" }, false},
+	}
+
+	for _, tt := range tests {
+		var sr = sign()
+		tt.change(sr)
+
+		r, err := sr.Verify()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: Verify() = %v, want valid: %v", tt.name, err, tt.valid)
+			continue
+		}
+
+		if err == nil && (r.PeakActiveUsers != 7 || !r.GeneratedAt.Equal(at) || r.Resources[QuotaRecords] != 42) {
+			t.Errorf("%s: Verify() returned %+v, want signed report", tt.name, r)
+		}
+	}
+}
+
+func TestUpdateUsagePeak(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	ts, restore := useTestSettings(nil)
+	defer restore()
+
+	var since = at.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		stored string
+		active uint
+		want   usagePeak
+	}{
+		{"new period", "", 3, usagePeak{Active: 3, Since: at}},
+		{"raised", `{"active":2,"since":"2019-06-01T11:00:00Z"}`, 3, usagePeak{Active: 3, Since: since}},
+		{"kept", `{"active":5,"since":"2019-06-01T11:00:00Z"}`, 3, usagePeak{Active: 5, Since: since}},
+		{"invalid", `{"active":"many"}`, 3, usagePeak{Active: 3, Since: at}},
+	}
+
+	for _, tt := range tests {
+		if tt.stored == "" {
+			delete(ts.vv, settingUsagePeakKey)
+		} else {
+			ts.vv[settingUsagePeakKey] = tt.stored
+		}
+
+		peak, err := updateUsagePeak(context.Background(), tt.active)
+		if err != nil {
+			t.Fatalf("%s: updateUsagePeak() = %v", tt.name, err)
+		}
+
+		if peak.Active != tt.want.Active || !peak.Since.Equal(tt.want.Since) {
+			t.Errorf("%s: updateUsagePeak() = %+v, want %+v", tt.name, *peak, tt.want)
+		}
+
+		var stored = usagePeak{}
+		if err = json.Unmarshal([]byte(ts.vv[settingUsagePeakKey]), &stored); err != nil || stored.Active != tt.want.Active {
+			t.Errorf("%s: stored peak %s, want %+v", tt.name, ts.vv[settingUsagePeakKey], tt.want)
+		}
+	}
+}
+
+func TestUsageReportDue(t *testing.T) {
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer fixClock(at)()
+
+	ts, restore := useTestSettings(nil)
+	defer restore()
+
+	reported := func(d time.Duration) string {
+		return at.Add(-d).Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		interval time.Duration
+		reported string
+		due      bool
+	}{
+		{"never reported", "reports", 24 * time.Hour, "", true},
+		{"reported in this interval", "reports", 24 * time.Hour, reported(23 * time.Hour), false},
+		{"interval passed", "reports", 24 * time.Hour, reported(24 * time.Hour), true},
+		{"no directory", "", 24 * time.Hour, "", false},
+		{"no interval", "reports", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		opt.UsageReportDir = tt.dir
+		opt.UsageReportInterval = tt.interval
+
+		if tt.reported == "" {
+			delete(ts.vv, settingUsageReportedKey)
+		} else {
+			ts.vv[settingUsageReportedKey] = tt.reported
+		}
+
+		due, err := usageReportDue(context.Background())
+		if err != nil {
+			t.Fatalf("%s: usageReportDue() = %v", tt.name, err)
+		}
+
+		if due != tt.due {
+			t.Errorf("%s: usageReportDue() = %v, want %v", tt.name, due, tt.due)
+		}
+	}
+}
+
+func TestCollectUsageLocked(t *testing.T) {
+	locks, restoreLocks := useTestLocks()
+	defer restoreLocks()
+
+	locks.held[usageLockName] = true
+
+	if _, err := CollectUsage(context.Background(), false); err == nil {
+		t.Errorf("CollectUsage() collected usage w/o holding the usage lock")
+	}
+
+	if _, err := sampleUsage(context.Background()); err == nil {
+		t.Errorf("sampleUsage() sampled usage w/o holding the usage lock")
+	}
+}
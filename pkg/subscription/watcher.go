@@ -0,0 +1,150 @@
+package subscription
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cortezaproject/corteza-server/pkg/sentry"
+)
+
+type (
+	// Keeps the last subscription key we've loaded
+	watchedKey struct {
+		sync.Mutex
+		key string
+	}
+)
+
+const (
+	// Never matches any loaded key and forces reload on next check
+	invalidatedKey = "\x00"
+)
+
+var (
+	watched = &watchedKey{key: invalidatedKey}
+)
+
+func (w *watchedKey) set(key string) {
+	w.Lock()
+	defer w.Unlock()
+	w.key = key
+}
+
+// changed returns true when key differs from the last one
+//
+// New key is remembered (see set) once it is loaded, so that
+// keys that could not be checked are checked again
+func (w *watchedKey) changed(key string) bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.key != key
+}
+
+// Watch periodically checks subscription key setting for changes
+//
+// When key changes it is re-parsed and current subscription is updated
+// (or reset when new key is invalid). Errors while reading settings and
+// transient errors (see isTransient) are logged and current subscription
+// is kept until the next check.
+func Watch(ctx context.Context) {
+	if opt.WatchInterval <= 0 {
+		logger.Debug("watcher disabled")
+		return
+	}
+
+	go func() {
+		defer sentry.Recover()
+
+		var ticker = time.NewTicker(opt.WatchInterval)
+		defer ticker.Stop()
+
+		auditExpiry(ctx)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reload(ctx)
+				auditExpiry(ctx)
+				publishState(ctx)
+			}
+		}
+	}()
+
+	logger.Debug("watcher initialized", zap.Duration("interval", opt.WatchInterval))
+}
+
+// Reloads subscription when key changes
+func reload(ctx context.Context) {
+	if err := createTables(ctx); err != nil {
+		logger.Warn("could not create subscription tables", zap.Error(err))
+	}
+
+	if changed, err := loadRevocations(ctx); err != nil {
+		logger.Warn("could not check subscription revocation list", zap.Error(err))
+	} else if changed {
+		// Force re-parsing of the current key
+		watched.set(invalidatedKey)
+		tenants.invalidate()
+	}
+
+	if err := loadBranding(ctx); err != nil {
+		logger.Warn("could not check subscription branding", zap.Error(err))
+	}
+
+	if err := loadTenants(ctx); err != nil {
+		logger.Warn("could not check organisation subscriptions", zap.Error(err))
+	}
+
+	key, source, err := loadKey(ctx)
+	if err != nil {
+		// Most likely a transient db or fs error, keep the current state and retry later
+		logger.Warn("could not check subscription key, keeping current subscription", zap.String("source", source), zap.Error(err))
+		return
+	}
+
+	if !watched.changed(key) {
+		return
+	}
+
+	if prev := Source(); prev != source {
+		logger.Info("subscription source changed", zap.String("from", prev), zap.String("to", source))
+	}
+
+	setActiveSource(source)
+
+	if key == "" {
+		logger.Info("subscription key removed, falling back to trial")
+
+		c := genericTrial(ctx)
+		if c == nil {
+			// Could not load or create trial, try again on next tick
+			return
+		}
+
+		watched.set(key)
+		UpdateCurrent(c)
+		return
+	}
+
+	c, err := parseInstalled(ctx, key)
+	if isTransient(err) {
+		logger.Warn("could not check subscription key, keeping current subscription", zap.String("source", source), zap.Error(err))
+		return
+	}
+
+	watched.set(key)
+
+	if err != nil {
+		logger.Warn("subscription key changed but is invalid, resetting subscription", zap.String("source", source), zap.Error(err))
+		ResetCurrent()
+	} else {
+		logger.Info("subscription key changed", zap.String("source", source))
+		UpdateCurrent(c)
+		audit(ctx, AuditKeyChanged, c, "subscription key changed, source: "+source)
+	}
+}
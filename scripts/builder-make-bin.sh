@@ -14,4 +14,9 @@ LDFLAGS=""
 LDFLAGS="${LDFLAGS} -X github.com/cortezaproject/corteza-server/internal/version.BuildTime=${BUILD_TIME}"
 LDFLAGS="${LDFLAGS} -X github.com/cortezaproject/corteza-server/internal/version.Version=${GIT_TAG}"
 
+# Secret for generic trial record MAC, keep it out of the repository
+if [ -n "${TRIAL_SECRET:-}" ]; then
+  LDFLAGS="${LDFLAGS} -X github.com/crusttech/crust-server/pkg/subscription.trialSecret=${TRIAL_SECRET}"
+fi
+
 go build -ldflags "${LDFLAGS}" -o $DST ./cmd/$APP/*.go